@@ -7,6 +7,9 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,25 +21,30 @@ type analytics struct {
 }
 
 type ProductRevenue struct {
-	ProductID    uuid.UUID `json:"product_id"`
-	ProductName  string    `json:"product_name"`
-	TotalRevenue float64   `json:"total_revenue"`
+	ProductID   uuid.UUID `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	// TotalRevenue is net of discounts, voids and refunds, GrossRevenue being
+	// what the sales came to before any of those.
+	TotalRevenue float64 `json:"total_revenue"`
+	GrossRevenue float64 `json:"gross_revenue"`
 }
 
-func (a *analytics) GetTopProducts(ctx context.Context, merchantID uuid.UUID) ([]ProductRevenue, error) {
-	query := `
+func (a *analytics) GetTopProducts(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID) ([]ProductRevenue, error) {
+	filter, args := inLocations("r.location_id", locations)
+	query := fmt.Sprintf(`
         SELECT 
           p.id AS product_id,
           p.name AS product_name,
-          SUM(p.price_cents * tl.quantity) AS total_revenue
+          SUM(r.revenue) AS total_revenue,
+          SUM(r.gross_revenue) AS gross_revenue
         FROM main.products p
-        JOIN main.transaction_lines tl ON p.id = tl.product_id
-          WHERE tl.merchant_id = ?
+        JOIN main.daily_product_rollups r ON p.id = r.product_id
+          WHERE r.merchant_id = ?%s
         GROUP BY p.id, p.name
         ORDER BY total_revenue DESC, product_name ASC
         LIMIT 5;
-    `
-	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, merchantID)
+    `, and(filter))
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, append([]any{merchantID}, args...)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
@@ -45,7 +53,7 @@ func (a *analytics) GetTopProducts(ctx context.Context, merchantID uuid.UUID) ([
 	var res []ProductRevenue
 	for rows.Next() {
 		var product ProductRevenue
-		if err := rows.Scan(&product.ProductID, &product.ProductName, &product.TotalRevenue); err != nil {
+		if err := rows.Scan(&product.ProductID, &product.ProductName, &product.TotalRevenue, &product.GrossRevenue); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 		res = append(res, product)
@@ -57,43 +65,273 @@ func (a *analytics) GetTopProducts(ctx context.Context, merchantID uuid.UUID) ([
 	return res, nil
 }
 
-func (a *analytics) csvDump(ctx context.Context, w io.Writer, merchantID uuid.UUID) error {
-	db := sql.OpenDB(a.connector)
+type DailyRevenue struct {
+	Day     time.Time `json:"day"`
+	Revenue float64   `json:"revenue"`
+}
+
+// GetDailyRevenue returns one entry per calendar day between the merchant's first
+// and last transaction, days without sales being reported as zero revenue.
+func (a *analytics) GetDailyRevenue(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID) ([]DailyRevenue, error) {
+	filter, args := inLocations("r.location_id", locations)
+	query := fmt.Sprintf(`
+        SELECT
+          CAST(r.day AS TIMESTAMP) AS day,
+          SUM(r.revenue) AS revenue
+        FROM main.daily_product_rollups r
+          WHERE r.merchant_id = ?%s
+        GROUP BY r.day
+        ORDER BY day ASC;
+    `, and(filter))
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, append([]any{merchantID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var res []DailyRevenue
+	for rows.Next() {
+		var day DailyRevenue
+		if err := rows.Scan(&day.Day, &day.Revenue); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		for len(res) > 0 && res[len(res)-1].Day.AddDate(0, 0, 1).Before(day.Day) {
+			res = append(res, DailyRevenue{Day: res[len(res)-1].Day.AddDate(0, 0, 1)})
+		}
+		res = append(res, day)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+	return res, nil
+}
+
+// CategoryRevenue totals a category and, for top level categories, breaks it
+// down by subcategory.
+type CategoryRevenue struct {
+	ID            uuid.UUID         `json:"id"`
+	Name          string            `json:"name"`
+	Revenue       float64           `json:"revenue"`
+	Units         int64             `json:"units"`
+	Subcategories []CategoryRevenue `json:"subcategories,omitempty"`
+}
+
+// GetCategoryRevenue rolls revenue and units up the category hierarchy, products
+// without a category being left out. Products filed directly under a top level
+// category count towards it without a subcategory.
+func (a *analytics) GetCategoryRevenue(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID) ([]CategoryRevenue, error) {
+	filter, args := inLocations("r.location_id", locations)
+	query := fmt.Sprintf(`
+        SELECT
+          COALESCE(c.id, sc.id) AS category_id,
+          COALESCE(c.name, sc.name) AS category_name,
+          CASE WHEN c.id IS NOT NULL THEN sc.id END AS subcategory_id,
+          CASE WHEN c.id IS NOT NULL THEN sc.name END AS subcategory_name,
+          CAST(SUM(r.revenue) AS DOUBLE) AS revenue,
+          CAST(SUM(r.units) AS BIGINT) AS units
+        FROM main.daily_product_rollups r
+        JOIN main.products p ON p.id = r.product_id
+        JOIN main.categories sc ON sc.id = p.category_id
+        LEFT JOIN main.categories c ON c.id = sc.parent_id
+          WHERE r.merchant_id = ?%s
+        GROUP BY ALL
+        ORDER BY category_name ASC, category_id ASC, subcategory_name ASC NULLS FIRST;
+    `, and(filter))
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, append([]any{merchantID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var res []CategoryRevenue
+	for rows.Next() {
+		var category CategoryRevenue
+		var subcategoryID uuid.NullUUID
+		var subcategoryName sql.NullString
+		var revenue float64
+		var units int64
+		if err := rows.Scan(&category.ID, &category.Name, &subcategoryID, &subcategoryName, &revenue, &units); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if len(res) == 0 || res[len(res)-1].ID != category.ID {
+			res = append(res, category)
+		}
+		c := &res[len(res)-1]
+		c.Revenue += revenue
+		c.Units += units
+		if subcategoryID.Valid {
+			c.Subcategories = append(c.Subcategories, CategoryRevenue{
+				ID:      subcategoryID.UUID,
+				Name:    subcategoryName.String,
+				Revenue: revenue,
+				Units:   units,
+			})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+	return res, nil
+}
+
+// LocationRevenue totals a location's trade, transactions made nowhere in
+// particular being reported under a nil id.
+type LocationRevenue struct {
+	ID           uuid.NullUUID `json:"id"`
+	Name         *string       `json:"name"`
+	Revenue      float64       `json:"revenue"`
+	Units        int64         `json:"units"`
+	Transactions int64         `json:"transactions"`
+}
+
+// GetLocationRevenue breaks the merchant's trade down by location, busiest
+// first.
+func (a *analytics) GetLocationRevenue(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID) ([]LocationRevenue, error) {
+	// the rollups count sales per product, so a location's sales are counted
+	// from the transactions themselves
+	trade, tradeArgs := inLocations("r.location_id", locations)
+	sales, salesArgs := inLocations("location_id", locations)
+	query := fmt.Sprintf(`
+        WITH trade AS (
+          SELECT
+            r.location_id,
+            CAST(SUM(r.revenue) AS DOUBLE) AS revenue,
+            CAST(SUM(r.units) AS BIGINT) AS units
+          FROM main.daily_product_rollups r
+            WHERE r.merchant_id = ?%s
+          GROUP BY r.location_id
+        ), sales AS (
+          SELECT location_id, COUNT(*) AS transactions
+          FROM main.transactions
+            WHERE merchant_id = ? AND kind = 'sale'%s
+          GROUP BY location_id
+        )
+        SELECT tr.location_id, l.name, tr.revenue, tr.units, COALESCE(s.transactions, 0)
+        FROM trade tr
+        LEFT JOIN sales s ON s.location_id IS NOT DISTINCT FROM tr.location_id
+        LEFT JOIN main.locations l ON l.id = tr.location_id
+        ORDER BY tr.revenue DESC, l.name ASC;
+    `, and(trade), and(sales))
+	args := append(append([]any{merchantID}, tradeArgs...), merchantID)
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, append(args, salesArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	res := []LocationRevenue{}
+	for rows.Next() {
+		var location LocationRevenue
+		if err := rows.Scan(&location.ID, &location.Name, &location.Revenue, &location.Units, &location.Transactions); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		res = append(res, location)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+	return res, nil
+}
+
+// inLocations renders a filter of column to the given locations and its
+// arguments, nothing when there are no locations to filter to.
+func inLocations(column string, locations []uuid.UUID) (string, []any) {
+	if len(locations) == 0 {
+		return "", nil
+	}
+	placeholders := make([]string, len(locations))
+	args := make([]any, len(locations))
+	for i, location := range locations {
+		placeholders[i] = "?"
+		args[i] = location
+	}
+	return fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")), args
+}
 
-	zip := zip.NewWriter(w)
-	defer zip.Close()
+// inProducts renders a filter of column to the given products like inLocations.
+func inProducts(column string, products []uuid.UUID) (string, []any) {
+	return inLocations(column, products)
+}
 
+// and prefixes a filter for appending it to a WHERE clause.
+func and(filter string) string {
+	if filter == "" {
+		return ""
+	}
+	return " AND " + filter
+}
+
+type tableInfo struct {
+	Schema string
+	Name   string
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// merchantTables lists every table holding merchant data, being those with a
+// merchant_id column.
+func merchantTables(ctx context.Context, db querier) ([]tableInfo, error) {
 	rows, err := db.QueryContext(ctx, `
         SELECT table_schema, table_name
         FROM information_schema.columns
         WHERE column_name = 'merchant_id'
-        GROUP BY table_schema, table_name;
+        GROUP BY table_schema, table_name
+        ORDER BY table_schema, table_name;
     `)
 	if err != nil {
-		return fmt.Errorf("failed to query information_schema: %w", err)
-	}
-
-	type info struct {
-		Schema string
-		Name   string
+		return nil, fmt.Errorf("failed to query information_schema: %w", err)
 	}
-	var tables []info
+	defer rows.Close()
 
+	var tables []tableInfo
 	for rows.Next() {
-		var schema, name string
-		if err := rows.Scan(&schema, &name); err != nil {
-			return fmt.Errorf("failed to scan table info: %w", err)
+		var table tableInfo
+		if err := rows.Scan(&table.Schema, &table.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan table info: %w", err)
 		}
-		tables = append(tables, info{Schema: schema, Name: name})
+		tables = append(tables, table)
 	}
 	if err := rows.Err(); err != nil {
-		return fmt.Errorf("error iterating over table list: %w", err)
+		return nil, fmt.Errorf("error iterating over table list: %w", err)
+	}
+	return tables, nil
+}
+
+// locationScopes narrow the tables holding a location's trade down to that
+// location for a single location export, the rest being exported whole.
+var locationScopes = map[string]string{
+	"customers":         "id IN (SELECT customer_id FROM main.transactions WHERE location_id = ?)",
+	"locations":         "id = ?",
+	"transactions":      "location_id = ?",
+	"transaction_lines": "transaction_id IN (SELECT id FROM main.transactions WHERE location_id = ?)",
+	"stock_movements":   "location_id = ?",
+	"payments":          "transaction_id IN (SELECT id FROM main.transactions WHERE location_id = ?)",
+}
+
+// csvDump zips up the merchant's tables as CSV, only the given location's trade
+// when there is one.
+func (a *analytics) csvDump(ctx context.Context, w io.Writer, merchantID uuid.UUID, location *uuid.UUID) error {
+	db := sql.OpenDB(a.connector)
+
+	archive := zip.NewWriter(w)
+	tables, err := merchantTables(ctx, db)
+	if err != nil {
+		return err
 	}
-	rows.Close()
 
 	for _, table := range tables {
+		if derived[table.Name] {
+			continue
+		}
+
 		fileName := fmt.Sprintf("%s_%s.csv", table.Schema, table.Name)
-		csvFile, err := zip.Create(fileName)
+		csvFile, err := archive.Create(fileName)
 		if err != nil {
 			return fmt.Errorf("failed to create CSV file in ZIP for %s: %w", table.Name, err)
 		}
@@ -129,8 +367,13 @@ func (a *analytics) csvDump(ctx context.Context, w io.Writer, merchantID uuid.UU
 			return fmt.Errorf("failed to write column headers for %s: %w", table.Name, err)
 		}
 
-		selectQuery := fmt.Sprintf("SELECT * EXCLUDE(merchant_id) FROM %s WHERE merchant_id = ?", table.Name)
-		dataRows, err := db.QueryContext(ctx, selectQuery, merchantID)
+		selectQuery := fmt.Sprintf("SELECT * EXCLUDE(merchant_id) FROM %s.%s WHERE merchant_id = ?", ident(table.Schema), ident(table.Name))
+		args := []any{merchantID}
+		if scope, ok := locationScopes[table.Name]; ok && location != nil {
+			selectQuery += " AND " + scope
+			args = append(args, *location)
+		}
+		dataRows, err := db.QueryContext(ctx, selectQuery, args...)
 		if err != nil {
 			return fmt.Errorf("failed to query data from table %s: %w", table.Name, err)
 		}
@@ -196,5 +439,68 @@ func (a *analytics) csvDump(ctx context.Context, w io.Writer, merchantID uuid.UU
 		}
 	}
 
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to finish ZIP archive: %w", err)
+	}
+	return nil
+}
+
+// parquetDump zips up the merchant's tables as Parquet like csvDump does as
+// CSV. DuckDB only writes Parquet to files, so each table goes through a
+// scratch file before landing in the archive uncompressed, Parquet being
+// compressed already.
+func (a *analytics) parquetDump(ctx context.Context, w io.Writer, merchantID uuid.UUID, location *uuid.UUID) error {
+	db := sql.OpenDB(a.connector)
+
+	scratch, err := os.MkdirTemp("", "parquet-dump-")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	archive := zip.NewWriter(w)
+	tables, err := merchantTables(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if derived[table.Name] {
+			continue
+		}
+
+		// COPY takes no parameters, the ids being parsed uuids they are safe to
+		// inline
+		selectQuery := fmt.Sprintf("SELECT * EXCLUDE(merchant_id) FROM %s.%s WHERE merchant_id = '%s'", ident(table.Schema), ident(table.Name), merchantID)
+		if scope, ok := locationScopes[table.Name]; ok && location != nil {
+			selectQuery += " AND " + strings.ReplaceAll(scope, "?", fmt.Sprintf("'%s'", *location))
+		}
+
+		fileName := fmt.Sprintf("%s_%s.parquet", table.Schema, table.Name)
+		scratchFile := filepath.Join(scratch, fileName)
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			"COPY (%s) TO '%s' (FORMAT PARQUET);", selectQuery, strings.ReplaceAll(scratchFile, "'", "''"),
+		)); err != nil {
+			return fmt.Errorf("failed to write parquet for table %s: %w", table.Name, err)
+		}
+
+		parquetFile, err := archive.CreateHeader(&zip.FileHeader{Name: fileName, Method: zip.Store})
+		if err != nil {
+			return fmt.Errorf("failed to create parquet file in ZIP for %s: %w", table.Name, err)
+		}
+		f, err := os.Open(scratchFile)
+		if err != nil {
+			return fmt.Errorf("failed to open parquet for table %s: %w", table.Name, err)
+		}
+		_, err = io.Copy(parquetFile, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to archive parquet for table %s: %w", table.Name, err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to finish ZIP archive: %w", err)
+	}
 	return nil
 }
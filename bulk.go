@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bulk generates a merchant inside DuckDB with INSERT ... SELECT statements,
+// skipping the per row round trips of the appender. The distributions mirror the
+// Go generator by inverting cumulative weight tables through ASOF joins, but
+// rows come from DuckDB's random() so only the merchant rows and per table counts
+// are reproducible from the seed.
+func (g *generator) bulk(t task, w *worker, conn *sql.Conn) outcome {
+	ctx, lg, profile := t.ctx, t.lg, t.params.Profile
+	res := outcome{merchant: t.merchant}
+	rng := rand.New(rand.NewSource(t.merchant.Seed))
+
+	products := profile.Products.pick(rng)
+	transactions := profile.Transactions.pick(rng)
+	calendar := newCalendar(t.merchant.Until, profile)
+
+	categories, err := g.categories(ctx, conn, w, rng, t.merchant.ID)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	subcategories := make([]string, len(categories))
+	for i, id := range categories {
+		subcategories[i] = id.String()
+	}
+
+	locations, err := g.locations(ctx, conn, w, rng, t.merchant.ID, profile.Locations.pick(rng))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	// the location table inverts cumulative traffic like the others do
+	locationIDs := make([]string, len(locations.ids))
+	locationLows := make([]float64, len(locations.ids))
+	for i, id := range locations.ids {
+		locationIDs[i] = id.String()
+		if i > 0 {
+			locationLows[i] = locations.cumulative[i-1] / locations.cumulative[len(locations.cumulative)-1]
+		}
+	}
+
+	// the scratch tables can be as large as the merchant, connections outlive
+	// the generation so they are dropped rather than left behind
+	scratch := []string{
+		"bulk_products", "bulk_popularity", "bulk_days", "bulk_hours", "bulk_locations", "bulk_transactions",
+		"bulk_sales", "bulk_visits", "bulk_customers", "bulk_patrons", "bulk_lines", "bulk_reversals", "bulk_reversed_lines",
+		"bulk_tenders", "bulk_payments",
+	}
+	defer func() {
+		for _, table := range scratch {
+			_, _ = conn.ExecContext(context.Background(), fmt.Sprintf("DROP TABLE IF EXISTS %s;", table))
+		}
+	}()
+
+	// discounts draw a whole percentage off like DiscountPercent.pick does
+	const discountPercent = "(? + floor(random() * ?)) / 100"
+	discounts := []any{profile.DiscountPercent.Min, profile.DiscountPercent.Max - profile.DiscountPercent.Min + 1}
+
+	// Random draws are materialised in scratch tables before anything is derived
+	// from them, so that no draw ever gets evaluated twice.
+	steps := []struct {
+		table string
+		query string
+		args  []any
+	}{
+		{query: fmt.Sprintf(`
+            CREATE OR REPLACE TEMP TABLE bulk_products AS
+            SELECT
+              row_number() OVER () - 1 AS rank,
+              gen_random_uuid() AS id,
+              %[1]s[1 + floor(random() * len(%[1]s))::INTEGER] || ' ' || %[1]s[noun] AS name,
+              CAST(%[2]s[noun] AS UUID) AS category_id,
+              (? + floor(random() * ?))::INTEGER AS price_cents
+            FROM (SELECT 1 + floor(random() * len(%[1]s))::INTEGER AS noun FROM range(?));
+        `, literal(productNames), literal(subcategories)), args: []any{profile.PriceCents.Min, profile.PriceCents.Max - profile.PriceCents.Min + 1, products}},
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_popularity AS
+            SELECT rank, (SUM(weight) OVER (ORDER BY rank) - weight) / SUM(weight) OVER () AS lo
+            FROM (SELECT range AS rank, pow(1 + range, -?) AS weight FROM range(?));
+        `, args: []any{profile.Popularity, products}},
+		{query: fmt.Sprintf(`
+            CREATE OR REPLACE TEMP TABLE bulk_days AS
+            SELECT day, (SUM(weight) OVER (ORDER BY day) - weight) / SUM(weight) OVER () AS lo
+            FROM (
+              SELECT range AS day, %s[isodow(CAST(? AS DATE) + range::INTEGER)] * pow(1 + ?, range / 365) AS weight
+              FROM range(?)
+            )
+            WHERE weight > 0;
+        `, literal(profile.Weekdays[:])), args: []any{calendar.start, profile.Growth, profile.Days}},
+		{query: fmt.Sprintf(`
+            CREATE OR REPLACE TEMP TABLE bulk_hours AS
+            SELECT hour, (SUM(weight) OVER (ORDER BY hour) - weight) / SUM(weight) OVER () AS lo
+            FROM (SELECT range AS hour, %s[range + 1] AS weight FROM range(24))
+            WHERE weight > 0;
+        `, literal(hourWeights(profile)))},
+		{query: fmt.Sprintf(`
+            CREATE OR REPLACE TEMP TABLE bulk_locations AS
+            SELECT CAST(unnest(%s) AS UUID) AS id, unnest(%s) AS lo;
+        `, literal(locationIDs), literal(locationLows))},
+		{query: fmt.Sprintf(`
+            CREATE OR REPLACE TEMP TABLE bulk_transactions AS
+            SELECT
+              gen_random_uuid() AS id,
+              random() AS day,
+              random() AS hour,
+              random() AS offset,
+              random() AS location,
+              (? + floor(random() * ?))::INTEGER AS lines,
+              random() AS fate,
+              random() AS delay,
+              CASE WHEN random() < ? THEN %s ELSE 0 END AS order_discount
+            FROM range(?);
+        `, discountPercent), args: append(append([]any{profile.LinesPerTransaction.Min, profile.LinesPerTransaction.Max - profile.LinesPerTransaction.Min + 1, profile.OrderDiscountRate}, discounts...), transactions)},
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_sales AS
+            SELECT
+              t.id,
+              CAST(? AS TIMESTAMP) + to_days(d.day::INTEGER) + to_hours(h.hour::INTEGER) + to_microseconds((t.offset * 3600000000)::BIGINT) AS created_at,
+              t.lines,
+              t.fate,
+              t.delay,
+              t.order_discount,
+              l.id AS location_id
+            FROM bulk_transactions t
+            ASOF JOIN bulk_days d ON t.day >= d.lo
+            ASOF JOIN bulk_hours h ON t.hour >= h.lo
+            ASOF JOIN bulk_locations l ON t.location >= l.lo;
+        `, args: []any{calendar.start}},
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_visits AS
+            SELECT
+              id AS sale_id,
+              created_at,
+              random() < ? AS identified,
+              random() < ? AS repeat,
+              created_at - to_microseconds(CAST(least((1 / sqrt(1 - random()) - 1) * ?, ?) * ? AS BIGINT)) AS recalled
+            FROM bulk_sales;
+        `, args: []any{profile.IdentifiedRate, profile.RepeatRate, profile.ReturnDays, MAX_RETURN_DAYS, (24 * time.Hour).Microseconds()}},
+		// like visits, returning customers are the last won before the recalled
+		// time and anyone returning before any customer was won is a new one
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_customers AS
+            SELECT gen_random_uuid() AS id, sale_id, created_at
+            FROM bulk_visits
+              WHERE identified AND NOT repeat;
+        `},
+		{query: `
+            INSERT INTO bulk_customers
+            SELECT gen_random_uuid(), v.sale_id, v.created_at
+            FROM bulk_visits v
+              WHERE v.identified AND v.repeat
+              AND NOT EXISTS (SELECT 1 FROM bulk_customers c WHERE c.created_at <= v.recalled);
+        `},
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_patrons AS
+            SELECT sale_id, id AS customer_id FROM bulk_customers
+            UNION ALL
+            SELECT v.sale_id, c.id
+            FROM (
+              SELECT * FROM bulk_visits
+                WHERE identified AND repeat AND sale_id NOT IN (SELECT sale_id FROM bulk_customers)
+            ) v
+            ASOF JOIN bulk_customers c ON v.recalled >= c.created_at;
+        `},
+		{table: "products", query: `
+            INSERT INTO main.products (id, name, price_cents, merchant_id, category_id)
+            SELECT id, name, price_cents, ?, category_id FROM bulk_products;
+        `, args: []any{t.merchant.ID}},
+		{table: "transactions", query: `
+            INSERT INTO main.transactions (id, created_at, merchant_id, kind, customer_id, location_id)
+            SELECT s.id, s.created_at, ?, 'sale', p.customer_id, s.location_id
+            FROM bulk_sales s
+            LEFT JOIN bulk_patrons p ON p.sale_id = s.id;
+        `, args: []any{t.merchant.ID}},
+		{table: "customers", query: `
+            INSERT INTO main.customers (id, created_at, merchant_id)
+            SELECT id, created_at, ? FROM bulk_customers;
+        `, args: []any{t.merchant.ID}},
+		{query: fmt.Sprintf(`
+            CREATE OR REPLACE TEMP TABLE bulk_lines AS
+            SELECT
+              gen_random_uuid() AS id,
+              l.transaction_id,
+              p.id AS product_id,
+              %s AS quantity,
+              p.price_cents,
+              CASE WHEN random() < ? THEN %s ELSE 0 END AS line_discount,
+              l.order_discount
+            FROM (
+              SELECT transaction_id, order_discount, random() AS popularity
+              FROM (SELECT id AS transaction_id, order_discount, unnest(range(lines)) FROM bulk_sales)
+            ) l
+            ASOF JOIN bulk_popularity pop ON l.popularity >= pop.lo
+            JOIN bulk_products p ON p.rank = pop.rank;
+        `, quantityExpr(profile), discountPercent), args: append([]any{profile.DiscountRate}, discounts...)},
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_lines AS
+            SELECT
+              id, transaction_id, product_id, quantity, amount, discount, order_discount,
+              CAST(round((amount - discount - order_discount) * ?) AS BIGINT) AS tax
+            FROM (
+              SELECT *, CAST(round((amount - discount) * order_discount_rate) AS BIGINT) AS order_discount
+              FROM (
+                SELECT
+                  id, transaction_id, product_id, quantity, order_discount AS order_discount_rate,
+                  CAST(price_cents AS BIGINT) * quantity AS amount,
+                  CAST(round(CAST(price_cents AS BIGINT) * quantity * line_discount) AS BIGINT) AS discount
+                FROM bulk_lines
+              )
+            );
+        `, args: []any{profile.TaxRate}},
+		{table: "transaction_lines", query: `
+            INSERT INTO main.transaction_lines
+              (id, transaction_id, product_id, quantity, merchant_id, discount_cents, order_discount_cents, tax_cents)
+            SELECT id, transaction_id, product_id, quantity, ?, discount, order_discount, tax FROM bulk_lines;
+        `, args: []any{t.merchant.ID}},
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_reversals AS
+            SELECT * FROM (
+              SELECT
+                gen_random_uuid() AS id,
+                id AS sale_id,
+                location_id,
+                CASE WHEN fate < ? THEN 'void' ELSE 'refund' END AS kind,
+                created_at + to_microseconds(CAST(delay * CASE WHEN fate < ? THEN ? ELSE ? END AS BIGINT)) AS created_at
+              FROM bulk_sales
+                WHERE fate < ?
+            )
+              WHERE created_at < CAST(? AS TIMESTAMP);
+        `, args: []any{
+			profile.VoidRate,
+			profile.VoidRate, VOID_WINDOW.Microseconds(), REFUND_WINDOW.Microseconds(),
+			profile.VoidRate + profile.RefundRate,
+			calendar.until,
+		}},
+		{table: "transactions", query: `
+            INSERT INTO main.transactions (id, created_at, merchant_id, kind, original_transaction_id, customer_id, location_id)
+            SELECT r.id, r.created_at, ?, r.kind, r.sale_id, p.customer_id, r.location_id
+            FROM bulk_reversals r
+            LEFT JOIN bulk_patrons p ON p.sale_id = r.sale_id;
+        `, args: []any{t.merchant.ID}},
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_reversed_lines AS
+            SELECT * FROM (
+              SELECT
+                r.id AS transaction_id,
+                r.kind,
+                l.product_id, l.quantity, l.discount, l.order_discount, l.tax,
+                CASE WHEN r.kind = 'void' THEN l.quantity ELSE 1 + floor(random() * l.quantity)::INTEGER END AS units,
+                row_number() OVER (PARTITION BY r.id ORDER BY random()) AS pick
+              FROM bulk_reversals r
+              JOIN bulk_lines l ON l.transaction_id = r.sale_id
+            )
+              WHERE kind = 'void' OR pick = 1;
+        `},
+		{table: "transaction_lines", query: `
+            INSERT INTO main.transaction_lines
+              (id, transaction_id, product_id, quantity, merchant_id, discount_cents, order_discount_cents, tax_cents)
+            SELECT
+              gen_random_uuid(), transaction_id, product_id, -units, ?,
+              -CAST(round(discount * units / quantity) AS BIGINT),
+              -CAST(round(order_discount * units / quantity) AS BIGINT),
+              -CAST(round(tax * units / quantity) AS BIGINT)
+            FROM bulk_reversed_lines;
+        `, args: []any{t.merchant.ID}},
+		// sales are paid once priced, tender draws being kept apart from the
+		// tenders derived from them
+		{query: `
+            CREATE OR REPLACE TEMP TABLE bulk_tenders AS
+            SELECT
+              t.id AS transaction_id,
+              SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents + tl.tax_cents) AS total,
+              random() AS tender,
+              random() AS split,
+              random() AS other,
+              random() AS share
+            FROM main.transactions t
+            JOIN main.transaction_lines tl ON tl.transaction_id = t.id
+            JOIN main.products p ON p.id = tl.product_id
+              WHERE t.merchant_id = ? AND t.kind = 'sale'
+            GROUP BY t.id;
+        `, args: []any{t.merchant.ID}},
+		{query: fmt.Sprintf(`
+            CREATE OR REPLACE TEMP TABLE bulk_payments AS
+            SELECT
+              transaction_id,
+              total,
+              first,
+              CASE WHEN split < ? THEN %s END AS second,
+              CAST(round(total * (? + share * ?)) AS BIGINT) AS part
+            FROM (SELECT *, %s AS first FROM bulk_tenders);
+        `, tenderExpr(profile, "other", "first"), tenderExpr(profile, "tender", "")), args: []any{
+			profile.SplitRate, SPLIT_SHARE_MIN, 1 - 2*SPLIT_SHARE_MIN,
+		}},
+		// voids and refunds pay back to the tender their sale was first paid with
+		{table: "payments", query: `
+            INSERT INTO main.payments (id, transaction_id, tender, amount_cents, merchant_id)
+            SELECT gen_random_uuid(), transaction_id, first, CASE WHEN second IS NULL THEN total ELSE part END, ?
+            FROM bulk_payments
+            UNION ALL
+            SELECT gen_random_uuid(), transaction_id, second, total - part, ?
+            FROM bulk_payments
+              WHERE second IS NOT NULL
+            UNION ALL
+            SELECT
+              gen_random_uuid(),
+              t.id,
+              any_value(bp.first),
+              SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents + tl.tax_cents),
+              ?
+            FROM main.transactions t
+            JOIN main.transaction_lines tl ON tl.transaction_id = t.id
+            JOIN main.products p ON p.id = tl.product_id
+            JOIN bulk_payments bp ON bp.transaction_id = t.original_transaction_id
+              WHERE t.merchant_id = ? AND t.kind != 'sale'
+            GROUP BY t.id;
+        `, args: []any{t.merchant.ID, t.merchant.ID, t.merchant.ID, t.merchant.ID}},
+	}
+
+	var payments int
+	for _, step := range steps {
+		if res.err = ctx.Err(); res.err != nil {
+			return res
+		}
+
+		started := time.Now()
+		result, err := conn.ExecContext(ctx, step.query, step.args...)
+		if err != nil {
+			res.err = fmt.Errorf("failed bulk generation step for %s: %w", t.merchant.ID, err)
+			return res
+		}
+		if step.table == "" {
+			continue
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			res.err = fmt.Errorf("failed to count rows inserted into %s: %w", step.table, err)
+			return res
+		}
+		w.wroteMany(step.table, int(affected))
+		lg.WithField("quantity", affected).WithField("took", time.Since(started).String()).Infof("bulk inserted %s", step.table)
+
+		switch step.table {
+		case "products":
+			res.products += int(affected)
+		case "transactions":
+			res.transactions += int(affected)
+		case "transaction_lines":
+			res.lines += int(affected)
+		case "customers":
+			res.customers += int(affected)
+		case "payments":
+			payments += int(affected)
+		}
+	}
+
+	// sizes are only known once written, sales and their reversals alike
+	w.tracker.expect("products", res.products)
+	w.tracker.expect("transactions", res.transactions)
+	w.tracker.expect("transaction_lines", res.lines)
+	w.tracker.expect("customers", res.customers)
+	w.tracker.expect("payments", payments)
+
+	res.err = g.stock(ctx, conn, lg, w, rng, t.merchant.ID, calendar, profile)
+	return res
+}
+
+// quantityExpr is the SQL counterpart of quantity, the number of extra units
+// being geometrically distributed by inverting its CDF.
+func quantityExpr(p profile) string {
+	if p.QuantitySkew == 0 {
+		return strconv.Itoa(p.Quantity.Min)
+	}
+	return fmt.Sprintf("least(%d, %d + floor(ln(1 - random()) / ln(%s)))::INTEGER",
+		p.Quantity.Max, p.Quantity.Min, strconv.FormatFloat(p.QuantitySkew, 'g', -1, 64))
+}
+
+func hourWeights(p profile) []float64 {
+	weights := make([]float64, 24)
+	for hour := range weights {
+		weights[hour] = hourWeight(hour, p.OpeningHour, p.ClosingHour)
+	}
+	return weights
+}
+
+// literal renders a DuckDB list literal. Values may be caller provided, as the
+// profile's weights are, which is safe as floats are formatted as numbers and
+// strings are quote escaped, neither leaving room for SQL of their own.
+func literal[T string | float64](values []T) string {
+	items := make([]string, len(values))
+	for i, value := range values {
+		switch v := any(value).(type) {
+		case string:
+			items[i] = "'" + strings.ReplaceAll(v, "'", "''") + "'"
+		case float64:
+			items[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type category struct {
+	name          string
+	subcategories []subcategory
+}
+
+// subcategory holds the products whose name ends in one of its nouns.
+type subcategory struct {
+	name  string
+	nouns []string
+}
+
+// taxonomy files every one of the productNames under a subcategory.
+var taxonomy = []category{
+	{name: "Drivetrain", subcategories: []subcategory{
+		{name: "Gears", nouns: []string{"Gear", "Cog", "Sprocket", "Ratchet"}},
+		{name: "Linkages", nouns: []string{"Crank", "Lever", "Pulley"}},
+	}},
+	{name: "Electrical", subcategories: []subcategory{
+		{name: "Circuitry", nouns: []string{"Circuit", "Module", "Switch"}},
+		{name: "Actuators", nouns: []string{"Servo"}},
+	}},
+	{name: "Engine", subcategories: []subcategory{
+		{name: "Combustion", nouns: []string{"Piston", "Valve", "Rotor"}},
+		{name: "Ignition", nouns: []string{"Spark"}},
+	}},
+	{name: "Hardware", subcategories: []subcategory{
+		{name: "Fasteners", nouns: []string{"Bolt", "Spring"}},
+		{name: "Novelties", nouns: []string{"Widget", "Gizmo", "Nodule"}},
+	}},
+}
+
+// categories writes the merchant's categories, returning the id of the
+// subcategory of each of the productNames by index. There are few enough for a
+// single statement to do.
+func (g *generator) categories(ctx context.Context, conn *sql.Conn, w *worker, rng *rand.Rand, merchantID uuid.UUID) ([]uuid.UUID, error) {
+	subcategories := make(map[string]uuid.UUID)
+	var rows []string
+	var args []any
+	for _, c := range taxonomy {
+		parent := uuid.Must(uuid.NewRandomFromReader(rng))
+		rows = append(rows, "(?, ?, NULL, ?)")
+		args = append(args, parent, c.name, merchantID)
+
+		for _, sub := range c.subcategories {
+			id := uuid.Must(uuid.NewRandomFromReader(rng))
+			rows = append(rows, "(?, ?, ?, ?)")
+			args = append(args, id, sub.name, parent, merchantID)
+			for _, noun := range sub.nouns {
+				subcategories[noun] = id
+			}
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO main.categories (id, name, parent_id, merchant_id) VALUES %s;", strings.Join(rows, ", "),
+	), args...); err != nil {
+		return nil, fmt.Errorf("failed to insert categories: %w", err)
+	}
+	w.tracker.expect("categories", len(rows))
+	w.wroteMany("categories", len(rows))
+
+	res := make([]uuid.UUID, len(productNames))
+	for i, noun := range productNames {
+		res[i] = subcategories[noun]
+	}
+	return res, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	store "github.com/suessflorian/client-side-analytics/store/duckdb"
+	"github.com/suessflorian/client-side-analytics/telemetry"
+)
+
+// Commands other than serve print their result as JSON on stdout and exit 0 on
+// success, 1 on failure and 2 on invalid usage.
+
+func generateCommand(ctx context.Context, lg *logrus.Logger, args []string) int {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	seed := flags.Int64("seed", 0, "seed reproducing a previous generation, a random one is picked if not given")
+	until := flags.String("until", "", "date (YYYY-MM-DD) anchoring generated timestamps, defaults to today")
+	preset := flags.String("preset", DEFAULT_PRESET, "generation profile preset: tiny, typical or whale")
+	profile := flags.String("profile", "", "JSON overrides of the -preset profile")
+	bulk := flags.Bool("bulk", false, "generate rows inside duckdb, much faster but not reproducible from -seed")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of merchants generated in parallel")
+	_ = flags.Parse(args)
+
+	req := generateRequest{Preset: *preset, Bulk: *bulk}
+	if *profile != "" {
+		req.Profile = json.RawMessage(*profile)
+	}
+	// zero being a seed like any other, only a given -seed is passed on
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			req.Seed = seed
+		}
+	})
+	if *until != "" {
+		anchor, err := time.Parse(time.DateOnly, *until)
+		if err != nil {
+			lg.WithError(err).Error("invalid -until date")
+			return 2
+		}
+		req.Until = &anchor
+	}
+
+	params, err := req.generation()
+	if err != nil {
+		lg.WithError(err).Error("invalid generation profile")
+		return 2
+	}
+
+	connector, err := store.Init(ctx, lg, DATABASE)
+	if err != nil {
+		lg.WithError(err).Error("database connection failure")
+		return 1
+	}
+	defer connector.Close()
+
+	_, reporter := telemetry.New(ctx, lg)
+	generator, err := newMerchantGenerator(ctx, lg, reporter, connector, max(*workers, 1))
+	if err != nil {
+		lg.WithError(err).Error("failed to initialise merchant generator")
+		return 1
+	}
+
+	generated, err := generator.create(ctx, lg, reporter, params, nil)
+	if errors.Is(err, ErrMerchantExists) {
+		lg.WithError(err).WithField("seed", params.Seed).Error("seed already generated")
+		return 1
+	} else if err != nil {
+		lg.WithError(err).Error("failed to generate artefacts")
+		return 1
+	}
+
+	printJSON(generated)
+	return 0
+}
+
+// dumper writes a merchant's export to w, only the location's trade when given.
+type dumper func(a *analytics, ctx context.Context, w io.Writer, merchantID uuid.UUID, location *uuid.UUID) error
+
+// exportFormats map the export formats to what writes them.
+var exportFormats = map[string]dumper{
+	"csv":     (*analytics).csvDump,
+	"parquet": (*analytics).parquetDump,
+}
+
+func exportCommand(ctx context.Context, lg *logrus.Logger, args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	merchant := flags.String("merchant", "", "merchant to export")
+	location := flags.String("location", "", "only export the trade of this location")
+	format := flags.String("format", "csv", "format of the archived tables: csv or parquet")
+	out := flags.String("out", "", "file to write the zip archive to, - for stdout")
+	_ = flags.Parse(args)
+
+	merchantID, err := uuid.Parse(*merchant)
+	if err != nil {
+		lg.WithError(err).Error("invalid -merchant uuid")
+		return 2
+	}
+	var locationID *uuid.UUID
+	if *location != "" {
+		id, err := uuid.Parse(*location)
+		if err != nil {
+			lg.WithError(err).Error("invalid -location uuid")
+			return 2
+		}
+		locationID = &id
+	}
+	dump, ok := exportFormats[*format]
+	if !ok {
+		lg.WithField("format", *format).Error("invalid -format")
+		return 2
+	}
+	if *out == "" {
+		lg.Error("missing -out")
+		return 2
+	}
+
+	connector, err := store.Open(ctx, DATABASE)
+	if err != nil {
+		lg.WithError(err).Error("database connection failure")
+		return 1
+	}
+	defer connector.Close()
+
+	if err := store.Current(ctx, connector); err != nil {
+		lg.WithError(err).Error("database not migrated, run migrate up first")
+		return 1
+	}
+
+	var exists bool
+	if err := sql.OpenDB(connector).QueryRowContext(ctx, `
+        SELECT EXISTS (SELECT 1 FROM main.merchants WHERE id = ?);
+    `, merchantID).Scan(&exists); err != nil {
+		lg.WithError(err).Error("failed to look up merchant")
+		return 1
+	} else if !exists {
+		lg.WithField("merchant", merchantID).Error("unknown merchant")
+		return 1
+	}
+
+	a := &analytics{connector}
+	if *out == "-" {
+		if err := dump(a, ctx, os.Stdout, merchantID, locationID); err != nil {
+			lg.WithError(err).Error("failed to export merchant")
+			return 1
+		}
+	} else if err := exportFile(ctx, a, dump, *out, merchantID, locationID); err != nil {
+		lg.WithError(err).Error("failed to export merchant")
+		return 1
+	}
+
+	lg.WithFields(logrus.Fields{"merchant": merchantID, "format": *format, "out": *out}).Info("exported merchant")
+	return 0
+}
+
+// exportFile dumps the merchant into the named file, removing it again should
+// the export fail part way. Devices and pipes are written to but never removed.
+func exportFile(ctx context.Context, a *analytics, dump dumper, name string, merchantID uuid.UUID, location *uuid.UUID) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create -out file: %w", err)
+	}
+	if info, statErr := f.Stat(); statErr == nil && info.Mode().IsRegular() {
+		defer func() {
+			if err != nil {
+				_ = os.Remove(name)
+			}
+		}()
+	}
+
+	if err := dump(a, ctx, f, merchantID, location); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close -out file: %w", err)
+	}
+	return nil
+}
+
+func verifyCommand(ctx context.Context, lg *logrus.Logger, args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	merchant := flags.String("merchant", "", "merchant whose export is checked")
+	_ = flags.Parse(args)
+
+	merchantID, err := uuid.Parse(*merchant)
+	if err != nil {
+		lg.WithError(err).Error("invalid -merchant uuid")
+		return 2
+	}
+
+	connector, err := store.Init(ctx, lg, DATABASE)
+	if err != nil {
+		lg.WithError(err).Error("database connection failure")
+		return 1
+	}
+	defer connector.Close()
+
+	report, err := (&analytics{connector}).verifyRoundTrip(ctx, merchantID)
+	if err != nil {
+		lg.WithError(err).Error("failed to verify export round trip")
+		return 1
+	}
+
+	printJSON(report)
+
+	if !report.Faithful() {
+		lg.WithField("merchant", merchantID).Error("export does not reproduce server analytics")
+		return 1
+	}
+	lg.WithField("merchant", merchantID).Info("export reproduces server analytics")
+	return 0
+}
+
+func migrateCommand(ctx context.Context, lg *logrus.Logger, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: client-side-analytics migrate status|up")
+	}
+	_ = flags.Parse(args)
+
+	connector, err := store.Open(ctx, DATABASE)
+	if err != nil {
+		lg.WithError(err).Error("database connection failure")
+		return 1
+	}
+	defer connector.Close()
+
+	switch flags.Arg(0) {
+	case "status":
+		migrations, err := store.Status(ctx, connector)
+		if err != nil {
+			lg.WithError(err).Error("failed to list migrations")
+			return 1
+		}
+		printJSON(migrations)
+	case "up":
+		if err := store.Migrate(ctx, lg, connector); err != nil {
+			lg.WithError(err).Error("failed to migrate")
+			return 1
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+	return 0
+}
+
+func validateCommand(ctx context.Context, lg *logrus.Logger, args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	mode := flags.String("mode", INTEGRITY_REPORT, "report violations, or also repair or quarantine them")
+	samples := flags.Int("samples", INTEGRITY_SAMPLES, "number of violating rows shown per violation")
+	_ = flags.Parse(args)
+
+	if !integrityModes[*mode] {
+		lg.WithField("mode", *mode).Error("invalid -mode")
+		return 2
+	}
+	if *samples < 0 {
+		lg.WithField("samples", *samples).Error("invalid -samples")
+		return 2
+	}
+
+	connector, err := store.Init(ctx, lg, DATABASE)
+	if err != nil {
+		lg.WithError(err).Error("database connection failure")
+		return 1
+	}
+	defer connector.Close()
+
+	_, reporter := telemetry.New(ctx, lg)
+	generator, err := newMerchantGenerator(ctx, lg, reporter, connector, 1)
+	if err != nil {
+		lg.WithError(err).Error("failed to initialise merchant generator")
+		return 1
+	}
+
+	report, err := generator.checkIntegrity(ctx, lg, reporter, *mode, *samples)
+	if err != nil {
+		lg.WithError(err).Error("failed to check integrity")
+		return 1
+	}
+
+	printJSON(report)
+
+	if !report.Clean() {
+		lg.WithField("violations", len(report.Violations)).Error("integrity violations found")
+		return 1
+	}
+	lg.Info("no integrity violations")
+	return 0
+}
+
+// stats are the row counts of every table and the size of the database files,
+// the write ahead log included as it holds what is yet to be checkpointed.
+type stats struct {
+	Rows          map[string]int64 `json:"rows"`
+	DatabaseBytes int64            `json:"database_bytes"`
+}
+
+func statsCommand(ctx context.Context, lg *logrus.Logger, args []string) int {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	connector, err := store.Open(ctx, DATABASE)
+	if err != nil {
+		lg.WithError(err).Error("database connection failure")
+		return 1
+	}
+	defer connector.Close()
+
+	if err := store.Current(ctx, connector); err != nil {
+		lg.WithError(err).Error("database not migrated, run migrate up first")
+		return 1
+	}
+
+	res, err := tableStats(ctx, connector)
+	if err != nil {
+		lg.WithError(err).Error("failed to gather stats")
+		return 1
+	}
+
+	for _, file := range []string{DATABASE, DATABASE + ".wal"} {
+		info, err := os.Stat(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			lg.WithError(err).Error("failed to stat database file")
+			return 1
+		}
+		res.DatabaseBytes += info.Size()
+	}
+
+	printJSON(res)
+	return 0
+}
+
+func tableStats(ctx context.Context, connector *duckdb.Connector) (stats, error) {
+	db := sql.OpenDB(connector)
+
+	rows, err := db.QueryContext(ctx, `
+        SELECT table_schema, table_name
+        FROM information_schema.tables
+        WHERE table_type = 'BASE TABLE'
+        ORDER BY table_schema, table_name;
+    `)
+	if err != nil {
+		return stats{}, fmt.Errorf("failed to query information_schema: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []tableInfo
+	for rows.Next() {
+		var table tableInfo
+		if err := rows.Scan(&table.Schema, &table.Name); err != nil {
+			return stats{}, fmt.Errorf("failed to scan table info: %w", err)
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		return stats{}, fmt.Errorf("error iterating over table list: %w", err)
+	}
+
+	res := stats{Rows: make(map[string]int64)}
+	for _, table := range tables {
+		var count int64
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", ident(table.Schema), ident(table.Name))
+		if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+			return stats{}, fmt.Errorf("failed to get row count for table %s: %w", table.Name, err)
+		}
+		res.Rows[table.Name] = count
+	}
+	return res, nil
+}
+
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
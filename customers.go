@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MAX_RETURN_DAYS caps the gap between visits at the longest window a profile
+// can have, any longer gap amounting to the same and overflowing durations.
+const MAX_RETURN_DAYS = 3_650
+
+// customer is a generated customer, created by their first visit.
+type customer struct {
+	id        uuid.UUID
+	createdAt time.Time
+}
+
+// visits attributes the identified sales to customers. Going through the sales
+// in time order, an identified sale either wins a new customer or brings back
+// the last one won some gap before it. Customers thus become less likely to
+// return the longer ago they were won, which is what makes for retention curves
+// that tail off, the gap's heavy tail keeping a loyal few coming back for long.
+func visits(rng *rand.Rand, sales []sale, p profile) []customer {
+	order := make([]int, len(sales))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return sales[order[a]].at.Before(sales[order[b]].at) })
+
+	// customers are won in time order, so stay sorted by when they were won
+	var customers []customer
+	for _, i := range order {
+		if rng.Float64() >= p.IdentifiedRate {
+			continue
+		}
+
+		if rng.Float64() < p.RepeatRate {
+			gap := min(returnGap(rng.Float64())*p.ReturnDays, MAX_RETURN_DAYS)
+			recalled := sales[i].at.Add(-time.Duration(gap * float64(24*time.Hour)))
+			won := sort.Search(len(customers), func(c int) bool { return customers[c].createdAt.After(recalled) })
+			if won > 0 {
+				id := customers[won-1].id
+				sales[i].customer = &id
+				continue
+			}
+		}
+
+		// nobody was won early enough to be returning, so this is a new customer
+		id := uuid.Must(uuid.NewRandomFromReader(rng))
+		customers = append(customers, customer{id: id, createdAt: sales[i].at})
+		sales[i].customer = &id
+	}
+	return customers
+}
+
+// returnGap inverts the CDF of a Lomax distribution with shape 2 and unit mean
+// at u, its tail being much heavier than an exponential's.
+func returnGap(u float64) float64 {
+	return 1/math.Sqrt(1-u) - 1
+}
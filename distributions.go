@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// calendar samples transaction timestamps over the profile's window, weighting
+// days by weekday and growth trend, and hours by a business day curve.
+type calendar struct {
+	start time.Time
+	until time.Time
+	days  []float64
+	hours []float64
+}
+
+func newCalendar(until time.Time, p profile) *calendar {
+	c := &calendar{start: until.AddDate(0, 0, -p.Days), until: until}
+
+	var total float64
+	for day := 0; day < p.Days; day++ {
+		date := c.start.AddDate(0, 0, day)
+		years := float64(day) / 365
+		// time.Weekday counts from Sunday, weights are listed from Monday
+		total += p.Weekdays[(int(date.Weekday())+6)%7] * math.Pow(1+p.Growth, years)
+		c.days = append(c.days, total)
+	}
+
+	total = 0
+	for hour := 0; hour < 24; hour++ {
+		total += hourWeight(hour, p.OpeningHour, p.ClosingHour)
+		c.hours = append(c.hours, total)
+	}
+
+	return c
+}
+
+// hourWeight is flat trading through opening hours, with a lunch peak and a
+// smaller after work one.
+func hourWeight(hour, opening, closing int) float64 {
+	if hour < opening || hour >= closing {
+		return 0
+	}
+	switch hour {
+	case 12, 13:
+		return 2
+	case 17, 18:
+		return 1.5
+	}
+	return 1
+}
+
+func (c *calendar) sample(rng *rand.Rand) time.Time {
+	day := pick(rng, c.days)
+	hour := pick(rng, c.hours)
+	return c.start.AddDate(0, 0, day).
+		Add(time.Duration(hour) * time.Hour).
+		Add(time.Duration(rng.Int63n(int64(time.Hour))))
+}
+
+// pick draws an index from cumulative weights.
+func pick(rng *rand.Rand, cumulative []float64) int {
+	target := rng.Float64() * cumulative[len(cumulative)-1]
+	i := sort.SearchFloat64s(cumulative, target)
+	// landing exactly on a boundary, or on zero weight entries sharing it, means
+	// the draw belongs to the next weighted entry
+	for i < len(cumulative)-1 && cumulative[i] <= target {
+		i++
+	}
+	return i
+}
+
+// popularity draws products Zipf distributed, the first product being the most
+// popular one.
+type popularity struct {
+	zipf *rand.Zipf
+}
+
+func newPopularity(rng *rand.Rand, p profile, products int) popularity {
+	return popularity{zipf: rand.NewZipf(rng, p.Popularity, 1, uint64(products-1))}
+}
+
+func (p popularity) sample() int {
+	return int(p.zipf.Uint64())
+}
+
+// quantity is geometric over the range, each further unit being added with the
+// profile's skew as probability, so single units dominate like they do in retail.
+func quantity(rng *rand.Rand, p profile) int {
+	q := p.Quantity.Min
+	for q < p.Quantity.Max && rng.Float64() < p.QuantitySkew {
+		q++
+	}
+	return q
+}
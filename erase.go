@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/suessflorian/client-side-analytics/telemetry"
+)
+
+var ErrUnknownMerchant = errors.New("unknown merchant")
+
+// Erasure is the receipt of a merchant's erasure, kept in the audit log of
+// main.erasures long after the merchant is gone. Rows counts what was purged
+// per table.
+type Erasure struct {
+	ID         uuid.UUID        `json:"id"`
+	MerchantID uuid.UUID        `json:"merchant_id"`
+	Name       string           `json:"name"`
+	Rows       map[string]int64 `json:"rows"`
+	ErasedAt   time.Time        `json:"erased_at"`
+}
+
+// erase purges the merchant from every merchant table, derived ones included,
+// and from the quarantine, writing the receipt in the same transaction so that
+// there is never one without the other.
+func (g *generator) erase(ctx context.Context, reporter *telemetry.Reporter, merchantID uuid.UUID) (Erasure, error) {
+	conn, err := sql.OpenDB(g.connector).Conn(ctx)
+	if err != nil {
+		return Erasure{}, fmt.Errorf("could not connect: %w", err)
+	}
+	defer conn.Close()
+
+	res := Erasure{ID: uuid.New(), MerchantID: merchantID, Rows: make(map[string]int64)}
+	if err := atomically(ctx, conn, func() error {
+		err := conn.QueryRowContext(ctx, `
+            SELECT name FROM main.merchants WHERE id = ?;
+        `, merchantID).Scan(&res.Name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrUnknownMerchant, merchantID)
+		} else if err != nil {
+			return fmt.Errorf("failed to look up merchant: %w", err)
+		}
+
+		tables, err := merchantTables(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			purged, err := conn.ExecContext(ctx, fmt.Sprintf(
+				"DELETE FROM %s.%s WHERE merchant_id = ?;", ident(table.Schema), ident(table.Name),
+			), merchantID)
+			if err != nil {
+				return fmt.Errorf("failed to purge %s: %w", table.Name, err)
+			}
+			if res.Rows[table.Name], err = purged.RowsAffected(); err != nil {
+				return fmt.Errorf("failed to count rows purged from %s: %w", table.Name, err)
+			}
+		}
+
+		purged, err := conn.ExecContext(ctx, `
+            DELETE FROM main.merchants WHERE id = ?;
+        `, merchantID)
+		if err != nil {
+			return fmt.Errorf("failed to purge merchant row: %w", err)
+		}
+		if res.Rows["merchants"], err = purged.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to count merchant rows purged: %w", err)
+		} else if res.Rows["merchants"] == 0 {
+			return fmt.Errorf("%w: %s", ErrUnknownMerchant, merchantID)
+		}
+
+		quarantined, err := conn.ExecContext(ctx, `
+            DELETE FROM main.quarantine WHERE merchant = ?;
+        `, merchantID)
+		if err != nil {
+			return fmt.Errorf("failed to purge quarantined rows: %w", err)
+		}
+		if res.Rows["quarantine"], err = quarantined.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to count quarantined rows purged: %w", err)
+		}
+
+		res.ErasedAt = time.Now().UTC()
+		rows, err := json.Marshal(res.Rows)
+		if err != nil {
+			return fmt.Errorf("failed to marshal erased rows: %w", err)
+		}
+		if _, err := conn.ExecContext(ctx, `
+            INSERT INTO main.erasures (id, merchant, name, erased, erased_at) VALUES (?, ?, ?, ?, ?);
+        `, res.ID, merchantID, res.Name, string(rows), res.ErasedAt); err != nil {
+			return fmt.Errorf("failed to write erasure receipt: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return Erasure{}, err
+	}
+
+	for table, count := range g.tallies() {
+		count.Add(-res.Rows[table])
+	}
+	g.report(reporter)
+	return res, nil
+}
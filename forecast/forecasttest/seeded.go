@@ -0,0 +1,42 @@
+// Package forecasttest keeps the seeded revenue series the forecast is tested
+// against, written by the main package from the generator and fitted by the
+// forecast package.
+package forecasttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Seeded is the daily revenue of the first merchant a generation draws from
+// Seed under Preset, anchored at Until.
+type Seeded struct {
+	Seed    int64     `json:"seed"`
+	Preset  string    `json:"preset"`
+	Until   string    `json:"until"`
+	Revenue []float64 `json:"revenue"`
+}
+
+func Load(path string) (Seeded, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Seeded{}, fmt.Errorf("failed to read seeded series: %w", err)
+	}
+	var res Seeded
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return Seeded{}, fmt.Errorf("failed to parse seeded series: %w", err)
+	}
+	return res, nil
+}
+
+func (s Seeded) Write(path string) error {
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal seeded series: %w", err)
+	}
+	if err := os.WriteFile(path, append(raw, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write seeded series: %w", err)
+	}
+	return nil
+}
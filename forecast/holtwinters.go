@@ -0,0 +1,131 @@
+package forecast
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrInsufficientData = errors.New("not enough observations to fit a model")
+
+// Model is an additive Holt-Winters model (level, trend and seasonal component).
+// A Period of 1 degrades to Holt's linear trend method, used when the series is
+// too short to carry two full seasons.
+type Model struct {
+	Alpha  float64 `json:"alpha"`
+	Beta   float64 `json:"beta"`
+	Gamma  float64 `json:"gamma"`
+	Period int     `json:"period"`
+	SSE    float64 `json:"sse"`
+
+	level    float64
+	trend    float64
+	seasonal []float64
+	sigma    float64
+	next     int
+}
+
+type Point struct {
+	Value float64 `json:"value"`
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+// grid is the set of smoothing parameters tried per component, a coarse search
+// is plenty for daily revenue and keeps fitting deterministic.
+var grid = []float64{0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9}
+
+// Fit picks the smoothing parameters minimising the one-step-ahead squared error
+// over the series.
+func Fit(series []float64, period int) (*Model, error) {
+	if len(series) < 2 {
+		return nil, ErrInsufficientData
+	}
+	if period < 1 || len(series) < 2*period {
+		period = 1
+	}
+
+	gammas := grid
+	if period == 1 {
+		gammas = []float64{0}
+	}
+
+	var best *Model
+	for _, alpha := range grid {
+		for _, beta := range grid {
+			for _, gamma := range gammas {
+				m := &Model{Alpha: alpha, Beta: beta, Gamma: gamma, Period: period}
+				m.run(series)
+				if best == nil || m.SSE < best.SSE {
+					best = m
+				}
+			}
+		}
+	}
+	return best, nil
+}
+
+func (m *Model) run(series []float64) {
+	p := m.Period
+
+	m.seasonal = make([]float64, p)
+	if p > 1 {
+		var first, second float64
+		for i := 0; i < p; i++ {
+			first += series[i]
+			second += series[p+i]
+		}
+		first, second = first/float64(p), second/float64(p)
+
+		m.level = first
+		m.trend = (second - first) / float64(p)
+		for i := 0; i < p; i++ {
+			m.seasonal[i] = series[i] - first
+		}
+	} else {
+		m.level = series[0]
+		m.trend = series[1] - series[0]
+	}
+
+	m.SSE = 0
+	for t := 1; t < len(series); t++ {
+		season := m.seasonal[t%p]
+		predicted := m.level + m.trend + season
+		residual := series[t] - predicted
+		m.SSE += residual * residual
+
+		previous := m.level
+		m.level = m.Alpha*(series[t]-season) + (1-m.Alpha)*(m.level+m.trend)
+		m.trend = m.Beta*(m.level-previous) + (1-m.Beta)*m.trend
+		if p > 1 {
+			m.seasonal[t%p] = m.Gamma*(series[t]-m.level) + (1-m.Gamma)*season
+		}
+	}
+
+	m.sigma = math.Sqrt(m.SSE / float64(len(series)-1))
+	m.next = len(series)
+}
+
+// Forecast projects the next horizon steps. The interval uses the analytical
+// variance of the additive model, z being the standard normal quantile of the
+// desired confidence level (1.96 for 95%).
+func (m *Model) Forecast(horizon int, z float64) []Point {
+	points := make([]Point, horizon)
+
+	var variance float64
+	for h := 1; h <= horizon; h++ {
+		season := m.seasonal[(m.next+h-1)%m.Period]
+		value := m.level + float64(h)*m.trend + season
+
+		if h > 1 {
+			c := m.Alpha * (1 + float64(h-1)*m.Beta)
+			if m.Period > 1 && (h-1)%m.Period == 0 {
+				c += m.Gamma * (1 - m.Alpha)
+			}
+			variance += c * c
+		}
+		width := z * m.sigma * math.Sqrt(1+variance)
+
+		points[h-1] = Point{Value: value, Lower: value - width, Upper: value + width}
+	}
+	return points
+}
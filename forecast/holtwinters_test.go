@@ -0,0 +1,121 @@
+package forecast
+
+import (
+	"math"
+	"testing"
+
+	"github.com/suessflorian/client-side-analytics/forecast/forecasttest"
+)
+
+// weekly builds days of an exact additive series, level plus trend per day plus
+// the day's season.
+func weekly(days int, level, trend float64, season []float64) []float64 {
+	series := make([]float64, days)
+	for t := range series {
+		series[t] = level + trend*float64(t) + season[t%len(season)]
+	}
+	return series
+}
+
+func TestFitRecoversSeason(t *testing.T) {
+	level, trend := 1000.0, 5.0
+	season := []float64{-300, -100, 0, 50, 100, 150, 100}
+
+	series := weekly(8*7, level, trend, season)
+	model, err := Fit(series, 7)
+	if err != nil {
+		t.Fatalf("failed to fit: %v", err)
+	}
+	if model.Period != 7 {
+		t.Fatalf("period = %d, want 7", model.Period)
+	}
+
+	for h, point := range model.Forecast(14, 1.96) {
+		day := len(series) + h
+		want := level + trend*float64(day) + season[day%7]
+		// the grid search only gets close to the smoothing that fits exactly
+		if math.Abs(point.Value-want) > 0.002*want {
+			t.Errorf("forecast of day %d = %.2f, want %.2f", day, point.Value, want)
+		}
+	}
+}
+
+func TestFitDegradesWithoutTwoSeasons(t *testing.T) {
+	model, err := Fit(weekly(10, 100, 2, []float64{0, 10, 20, 0, -10, -20, 0}), 7)
+	if err != nil {
+		t.Fatalf("failed to fit: %v", err)
+	}
+	if model.Period != 1 {
+		t.Errorf("period = %d, want 1", model.Period)
+	}
+
+	if _, err := Fit([]float64{1}, 7); err != ErrInsufficientData {
+		t.Errorf("fitting a single observation: err = %v, want %v", err, ErrInsufficientData)
+	}
+}
+
+func TestForecastIntervalWidensWithHorizon(t *testing.T) {
+	series := weekly(8*7, 1000, 5, []float64{-300, -100, 0, 50, 100, 150, 100})
+	// noise gives the model a residual spread to size intervals with
+	for i := range series {
+		series[i] += float64((i*37)%11 - 5)
+	}
+
+	model, err := Fit(series, 7)
+	if err != nil {
+		t.Fatalf("failed to fit: %v", err)
+	}
+
+	points := model.Forecast(28, 1.96)
+	previous := 0.0
+	for h, point := range points {
+		width := point.Upper - point.Lower
+		if width <= 0 {
+			t.Fatalf("interval at horizon %d has width %.4f", h+1, width)
+		}
+		if width < previous {
+			t.Errorf("interval narrows from %.4f to %.4f at horizon %d", previous, width, h+1)
+		}
+		previous = width
+	}
+	if first, last := points[0].Upper-points[0].Lower, previous; last <= first {
+		t.Errorf("interval at horizon 28 (%.4f) is no wider than at horizon 1 (%.4f)", last, first)
+	}
+}
+
+func TestFitIsStableOnSeededMerchant(t *testing.T) {
+	f, err := forecasttest.Load("testdata/seeded_revenue.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model, err := Fit(f.Revenue, 7)
+	if err != nil {
+		t.Fatalf("failed to fit: %v", err)
+	}
+	if model.Period != 7 || model.Alpha != 0.05 || model.Beta != 0.2 || model.Gamma != 0.5 {
+		t.Errorf("smoothing = (%v, %v, %v) over period %d, want (0.05, 0.2, 0.5) over period 7", model.Alpha, model.Beta, model.Gamma, model.Period)
+	}
+	if !near(model.SSE, 5.242848293121837e+10) {
+		t.Errorf("SSE = %v, want 5.242848293121837e+10", model.SSE)
+	}
+
+	next := model.Forecast(1, 1.96)[0]
+	for _, tc := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"value", next.Value, 64936.85428378671},
+		{"lower", next.Lower, 17365.587813579914},
+		{"upper", next.Upper, 112508.12075399351},
+	} {
+		if !near(tc.got, tc.want) {
+			t.Errorf("next day's %s = %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+// near tolerates the float drift of a different summation order.
+func near(got, want float64) bool {
+	return math.Abs(got-want) <= 1e-9*math.Abs(want)
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,104 +21,334 @@ const (
 	DIAGNOSTIC_TOTAL_TRANSACTION_LINES = "Total transaction lines"
 	DIAGNOSTIC_TOTAL_PRODUCTS          = "Total products"
 	DIAGNOSTIC_TOTAL_MERCHANTS         = "Total merchants"
+	DIAGNOSTIC_TOTAL_CUSTOMERS         = "Total customers"
 )
 
+// ErrMerchantExists refuses to generate a merchant again, a seed drawing the same
+// merchant ids every time.
+var ErrMerchantExists = errors.New("merchant already exists")
+
 type generator struct {
 	// overall keeps track of how many different entities exist overall.
 	overall   counts
 	connector *duckdb.Connector
+	// tasks feeds merchants to the worker pool.
+	tasks chan task
 }
 
 type counts struct {
-	Merchants    int
-	Products     int
-	Transactions int
-	Lines        int
+	Merchants    atomic.Int64
+	Products     atomic.Int64
+	Transactions atomic.Int64
+	Lines        atomic.Int64
+	Customers    atomic.Int64
 }
 
 type generated struct {
+	Seed         int64
+	Profile      profile
 	Merchants    []Merchant
 	Products     int
 	Transactions int
 	Lines        int
+	Customers    int
 }
 
 type Merchant struct {
 	ID   uuid.UUID
 	Name string
+	// Seed drives everything generated for the merchant, together with Until
+	// it reproduces the merchant's data exactly.
+	Seed  int64
+	Until time.Time
+}
+
+// generation parameterises a run of the generator, runs with equal parameters
+// produce identical data.
+type generation struct {
+	Seed int64
+	// Until anchors generated timestamps, which all fall before it.
+	Until   time.Time
+	Profile profile
+	// Bulk generates rows inside DuckDB rather than appending them from Go,
+	// trading reproducibility for volume.
+	Bulk bool
 }
 
-func newMerchantGenerator(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, connector *duckdb.Connector) (*generator, error) {
-	g := &generator{connector: connector}
+func newMerchantGenerator(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, connector *duckdb.Connector, workers int) (*generator, error) {
+	g := &generator{connector: connector, tasks: make(chan task)}
+	if err := g.recount(ctx, reporter); err != nil {
+		return nil, err
+	}
+
+	for id := 1; id <= workers; id++ {
+		go g.work(ctx, id)
+	}
+
+	lg.WithField("workers", workers).Info("generator idle")
+	return g, nil
+}
 
-	for table, count := range map[string]*int{
+// tallies maps the tables behind the overall counts to their counters.
+func (g *generator) tallies() map[string]*atomic.Int64 {
+	return map[string]*atomic.Int64{
 		"merchants":         &g.overall.Merchants,
 		"products":          &g.overall.Products,
 		"transactions":      &g.overall.Transactions,
 		"transaction_lines": &g.overall.Lines,
-	} {
+		"customers":         &g.overall.Customers,
+	}
+}
+
+// report sets the overall counts as they stand on the reporter.
+func (g *generator) report(reporter *telemetry.Reporter) {
+	reporter.Set(DIAGNOSTIC_TOTAL_MERCHANTS, g.overall.Merchants.Load())
+	reporter.Set(DIAGNOSTIC_TOTAL_PRODUCTS, g.overall.Products.Load())
+	reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTIONS, g.overall.Transactions.Load())
+	reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTION_LINES, g.overall.Lines.Load())
+	reporter.Set(DIAGNOSTIC_TOTAL_CUSTOMERS, g.overall.Customers.Load())
+}
+
+// recount resyncs the overall counts with the tables, needed whenever rows are
+// removed behind the generator's back.
+func (g *generator) recount(ctx context.Context, reporter *telemetry.Reporter) error {
+	for table, count := range g.tallies() {
+		var total int64
 		query := fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
-		if err := sql.OpenDB(g.connector).QueryRowContext(ctx, query).Scan(count); err != nil {
-			return nil, fmt.Errorf("failed to get row count for table %s: %w", table, err)
+		if err := sql.OpenDB(g.connector).QueryRowContext(ctx, query).Scan(&total); err != nil {
+			return fmt.Errorf("failed to get row count for table %s: %w", table, err)
 		}
+		count.Store(total)
 	}
 
-	reporter.Set(DIAGNOSTIC_TOTAL_MERCHANTS, g.overall.Merchants)
-	reporter.Set(DIAGNOSTIC_TOTAL_PRODUCTS, g.overall.Products)
-	reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTIONS, g.overall.Transactions)
-	reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTION_LINES, g.overall.Lines)
+	g.report(reporter)
+	return nil
+}
 
-	lg.Info("generator idle")
-	return g, nil
+// create generates merchants as parameterised, progress being reported to the
+// tracker when given one. Merchants are spread over the worker pool, each being
+// generated from its own seed so the outcome does not depend on scheduling.
+func (g *generator) create(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, params generation, tracker *progress) (generated, error) {
+	merchants := params.merchants()
+	tracker.plan(merchants, params.Profile)
+
+	var res = generated{
+		Seed:      params.Seed,
+		Profile:   params.Profile,
+		Merchants: merchants,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outcomes := make(chan outcome, len(merchants))
+	go func() {
+		for _, merchant := range merchants {
+			t := task{ctx: ctx, lg: lg, reporter: reporter, tracker: tracker, merchant: merchant, params: params, done: outcomes}
+			select {
+			case g.tasks <- t:
+			case <-ctx.Done():
+				outcomes <- outcome{merchant: merchant, err: ctx.Err()}
+			}
+		}
+	}()
+
+	var err error
+	for range merchants {
+		o := <-outcomes
+		res.Products += o.products
+		res.Transactions += o.transactions
+		res.Lines += o.lines
+		res.Customers += o.customers
+		if o.err != nil && err == nil {
+			err = o.err
+			cancel()
+		}
+	}
+
+	return res, err
 }
 
-func (g *generator) create(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, amount int) (generated, error) {
-	merchants, err := g.merchants(ctx, lg, reporter, amount)
+// generate builds a merchant and everything belonging to it in one transaction,
+// so a failed or cancelled merchant leaves no rows behind. The overall counts
+// only take committed rows into account.
+func (g *generator) generate(t task, w *worker) outcome {
+	ctx, merchant := t.ctx, t.merchant
+
+	conn, err := sql.OpenDB(g.connector).Conn(ctx)
 	if err != nil {
-		return generated{}, err
+		return outcome{merchant: merchant, err: fmt.Errorf("could not connect: %w", err)}
 	}
+	defer conn.Close()
 
-	var res = generated{
-		Merchants: merchants,
+	var res outcome
+	if err := atomically(ctx, conn, func() error {
+		if err := unclaimed(ctx, conn, merchant); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, `
+            INSERT INTO main.merchants (id, name, seed, generated_until) VALUES (?, ?, ?, ?);
+        `, merchant.ID, merchant.Name, merchant.Seed, merchant.Until); err != nil {
+			return fmt.Errorf("failed to insert merchant row: %w", err)
+		}
+		w.wrote("merchants")
+
+		if t.params.Bulk {
+			res = g.bulk(t, w, conn)
+		} else {
+			res = g.append(t, w, conn)
+		}
+		if res.err != nil {
+			return res.err
+		}
+
+		recorded, err := recordSales(ctx, conn, merchant.ID, time.Time{})
+		if err != nil {
+			return err
+		}
+		w.tracker.expect("stock_movements", int(recorded))
+		w.wroteMany("stock_movements", int(recorded))
+		if err := refreshStock(ctx, conn, merchant.ID, nil); err != nil {
+			return err
+		}
+
+		return refreshRollups(ctx, conn, merchant.ID, time.Time{}, nil)
+	}); err != nil {
+		return outcome{merchant: merchant, err: err}
 	}
 
-	for _, merchant := range merchants {
-		products, err := g.products(ctx, lg, reporter, merchant.ID, rand.Int()%100)
+	t.reporter.Set(DIAGNOSTIC_TOTAL_MERCHANTS, g.overall.Merchants.Add(1))
+	t.reporter.Set(DIAGNOSTIC_TOTAL_PRODUCTS, g.overall.Products.Add(int64(res.products)))
+	t.reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTIONS, g.overall.Transactions.Add(int64(res.transactions)))
+	t.reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTION_LINES, g.overall.Lines.Add(int64(res.lines)))
+	t.reporter.Set(DIAGNOSTIC_TOTAL_CUSTOMERS, g.overall.Customers.Add(int64(res.customers)))
+	t.tracker.complete(merchant)
+	return res
+}
+
+// unclaimed fails with ErrMerchantExists when the merchant is already stored.
+func unclaimed(ctx context.Context, conn *sql.Conn, merchant Merchant) error {
+	var exists bool
+	if err := conn.QueryRowContext(ctx, `
+        SELECT EXISTS (SELECT 1 FROM main.merchants WHERE id = ?);
+    `, merchant.ID).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up merchant: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("%w: %s (%s)", ErrMerchantExists, merchant.ID, merchant.Name)
+	}
+	return nil
+}
+
+// atomically runs fn in a transaction on the connection, rows appended through
+// the connection meanwhile commit or roll back together.
+func atomically(ctx context.Context, conn *sql.Conn, fn func() error) error {
+	if _, err := conn.ExecContext(ctx, "BEGIN TRANSACTION;"); err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// ending the transaction must not depend on the context, which may well be
+	// what got cancelled
+	if err := fn(); err != nil {
+		if _, rollbackErr := conn.ExecContext(context.Background(), "ROLLBACK;"); rollbackErr != nil {
+			return errors.Join(err, fmt.Errorf("failed to roll back: %w", rollbackErr))
+		}
+		return err
+	}
+	if _, err := conn.ExecContext(context.Background(), "COMMIT;"); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// append writes the merchant's rows through appenders sharing the connection,
+// and with it the transaction.
+func (g *generator) append(t task, w *worker, conn *sql.Conn) outcome {
+	ctx, lg, params := t.ctx, t.lg, t.params
+	res := outcome{merchant: t.merchant}
+	rng := rand.New(rand.NewSource(t.merchant.Seed))
+
+	categories, err := g.categories(ctx, conn, w, rng, t.merchant.ID)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	locations, err := g.locations(ctx, conn, w, rng, t.merchant.ID, params.Profile.Locations.pick(rng))
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	res.err = conn.Raw(func(driverConn any) error {
+		dc := driverConn.(driver.Conn)
+
+		products, err := g.products(ctx, dc, lg, w, rng, t.merchant.ID, categories, params.Profile.PriceCents, params.Profile.Products.pick(rng))
+		if err != nil {
+			return err
+		}
+		res.products = len(products)
+
+		sales, customers, err := g.transactions(ctx, dc, lg, w, rng, t.merchant.ID, newCalendar(t.merchant.Until, params.Profile), locations, params.Profile, params.Profile.Transactions.pick(rng))
 		if err != nil {
-			return res, err
+			return err
+		}
+		res.transactions = len(sales)
+
+		if err := g.customers(ctx, dc, lg, w, t.merchant.ID, customers); err != nil {
+			return err
 		}
-		res.Products += len(products)
+		res.customers = len(customers)
 
-		transactions, err := g.transactions(ctx, lg, reporter, merchant.ID, rand.Int()%100_000)
+		lines, err := g.lines(ctx, dc, lg, w, rng, t.merchant.ID, products, sales, params.Profile)
 		if err != nil {
-			return res, err
+			return err
 		}
-		res.Transactions += len(transactions)
+		res.lines = lines
 
-		lines, err := g.lines(ctx, lg, reporter, merchant.ID, products, transactions, len(transactions)*7)
+		reversals, reversed, err := g.adjustments(ctx, dc, lg, w, rng, t.merchant.ID, sales)
 		if err != nil {
-			return res, err
+			return err
 		}
-		res.Lines += len(lines)
+		res.transactions += reversals
+		res.lines += reversed
+
+		return g.payments(ctx, dc, lg, w, rng, t.merchant.ID, sales)
+	})
+	if res.err != nil {
+		return res
 	}
 
-	return res, err
+	res.err = g.stock(ctx, conn, lg, w, rng, t.merchant.ID, newCalendar(t.merchant.Until, params.Profile), params.Profile)
+	return res
 }
 
-func (g *generator) merchants(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, amount int) ([]Merchant, error) {
-	conn, err := g.connector.Connect(ctx)
+// merchants are those the generation's seed draws.
+func (params generation) merchants() []Merchant {
+	rng := rand.New(rand.NewSource(params.Seed))
+	return drawMerchants(rng, params.Until, params.Profile.Merchants.pick(rng))
+}
+
+// checkSeed fails with ErrMerchantExists when any merchant the seed draws is
+// already stored, so a generation can be refused before it starts. generate
+// checks again as it writes each merchant.
+func (g *generator) checkSeed(ctx context.Context, params generation) error {
+	conn, err := sql.OpenDB(g.connector).Conn(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect: %w", err)
+		return fmt.Errorf("could not connect: %w", err)
 	}
 	defer conn.Close()
 
-	appender, err := duckdb.NewAppenderFromConn(conn, "", "merchants")
-	if err != nil {
-		return nil, fmt.Errorf("failed to establish appender for merchants: %w", err)
+	for _, merchant := range params.merchants() {
+		if err := unclaimed(ctx, conn, merchant); err != nil {
+			return err
+		}
 	}
-	defer lg.WithField("quantity", amount).Info("flushing merchants to disk")
-	defer appender.Close()
+	return nil
+}
 
+// drawMerchants picks the merchants of a generation from its seed, their rows
+// being written by whichever worker generates them.
+func drawMerchants(rng *rand.Rand, until time.Time, amount int) []Merchant {
 	var names = []string{
 		"Tech",
 		"Spark",
@@ -154,141 +387,396 @@ func (g *generator) merchants(ctx context.Context, lg *logrus.Logger, reporter *
 
 	merchants := make([]Merchant, amount)
 	for i := 0; i < amount; i++ {
-		merchants[i].ID = uuid.New()
-		merchants[i].Name = names[rand.Int()%len(names)] + names[rand.Int()%len(names)] + " " + postfixes[rand.Int()%len(postfixes)]
-		if err := appender.AppendRow(
-			duckdb.UUID(merchants[i].ID),
-			merchants[i].Name,
-		); err != nil {
-			return nil, fmt.Errorf("failed to append merchant row: %w", err)
-		}
-		g.overall.Merchants++
-		reporter.Set(DIAGNOSTIC_TOTAL_MERCHANTS, g.overall.Merchants)
+		merchants[i].ID = uuid.Must(uuid.NewRandomFromReader(rng))
+		merchants[i].Name = names[rng.Int()%len(names)] + names[rng.Int()%len(names)] + " " + postfixes[rng.Int()%len(postfixes)]
+		merchants[i].Seed = rng.Int63()
+		merchants[i].Until = until
 	}
 
-	return merchants, nil
+	return merchants
 }
 
-func (g *generator) products(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, merchantID uuid.UUID, amount int) ([]uuid.UUID, error) {
-	conn, err := g.connector.Connect(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("could not connect: %w", err)
-	}
-	defer conn.Close()
+var productNames = []string{
+	"Gear",
+	"Widget",
+	"Cog",
+	"Circuit",
+	"Gizmo",
+	"Module",
+	"Bolt",
+	"Spring",
+	"Lever",
+	"Crank",
+	"Rotor",
+	"Piston",
+	"Valve",
+	"Switch",
+	"Spark",
+	"Servo",
+	"Pulley",
+	"Ratchet",
+	"Sprocket",
+	"Nodule",
+}
 
+// products draws the merchant's products, each filed under the subcategory of
+// the last word of its name.
+func (g *generator) products(ctx context.Context, conn driver.Conn, lg *logrus.Logger, w *worker, rng *rand.Rand, merchantID uuid.UUID, categories []uuid.UUID, prices Range, amount int) ([]product, error) {
 	appender, err := duckdb.NewAppenderFromConn(conn, "", "products")
 	if err != nil {
 		return nil, fmt.Errorf("failed to establish appender for products: %w", err)
 	}
 	defer lg.WithField("quantity", amount).Info("flushing products to disk")
+	w.tracker.expect("products", amount)
 	defer appender.Close()
 
-	var names = []string{
-		"Gear",
-		"Widget",
-		"Cog",
-		"Circuit",
-		"Gizmo",
-		"Module",
-		"Bolt",
-		"Spring",
-		"Lever",
-		"Crank",
-		"Rotor",
-		"Piston",
-		"Valve",
-		"Switch",
-		"Spark",
-		"Servo",
-		"Pulley",
-		"Ratchet",
-		"Sprocket",
-		"Nodule",
-	}
-
-	products := make([]uuid.UUID, amount)
+	products := make([]product, amount)
 	for i := 0; i < amount; i++ {
-		products[i] = uuid.Must(uuid.NewRandom())
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		products[i].id = uuid.Must(uuid.NewRandomFromReader(rng))
+		name, noun := productNames[rng.Int()%len(productNames)], rng.Int()%len(productNames)
+		products[i].price = prices.pick(rng)
 		if err := appender.AppendRow(
-			duckdb.UUID(products[i]),
-			names[rand.Int()%len(names)]+" "+names[rand.Int()%len(names)],
-			rand.Int31()%10_000+100,
+			duckdb.UUID(products[i].id),
+			name+" "+productNames[noun],
+			int32(products[i].price),
 			duckdb.UUID(merchantID),
+			duckdb.UUID(categories[noun]),
 		); err != nil {
 			return nil, fmt.Errorf("failed to append product row: %w", err)
 		}
-		g.overall.Products++
-		reporter.Set(DIAGNOSTIC_TOTAL_PRODUCTS, g.overall.Products)
+		w.wrote("products")
 	}
 
+	// appended rows only reach the transaction once flushed
+	if err := appender.Close(); err != nil {
+		return nil, fmt.Errorf("failed to flush products: %w", err)
+	}
 	return products, nil
 }
 
-func (g *generator) transactions(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, merchantID uuid.UUID, amount int) ([]uuid.UUID, error) {
-	conn, err := g.connector.Connect(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("could not connect: %w", err)
+// sale is a generated sale, customer being nil for anonymous ones. Sales that
+// get undone name the kind of transaction reversing them and when, keeping their
+// lines around to reverse. Once reversed they name the reversing transaction
+// and what it paid back.
+type sale struct {
+	id         uuid.UUID
+	at         time.Time
+	location   uuid.UUID
+	customer   *uuid.UUID
+	reversal   string
+	reversedAt time.Time
+	lines      []line
+	payments   []payment
+	reversedBy uuid.UUID
+	paidBack   int64
+}
+
+func (g *generator) transactions(ctx context.Context, conn driver.Conn, lg *logrus.Logger, w *worker, rng *rand.Rand, merchantID uuid.UUID, calendar *calendar, locations locationWeights, profile profile, amount int) ([]sale, []customer, error) {
+	sales := make([]sale, amount)
+	reversals := 0
+	for i := range sales {
+		sales[i].id = uuid.Must(uuid.NewRandomFromReader(rng))
+		sales[i].at = calendar.sample(rng)
+		sales[i].location = locations.sample(rng)
+
+		switch r := rng.Float64(); {
+		case r < profile.VoidRate:
+			sales[i].reversal = TRANSACTION_VOID
+			sales[i].reversedAt = sales[i].at.Add(time.Duration(rng.Int63n(int64(VOID_WINDOW))))
+		case r < profile.VoidRate+profile.RefundRate:
+			sales[i].reversal = TRANSACTION_REFUND
+			sales[i].reversedAt = sales[i].at.Add(time.Duration(rng.Int63n(int64(REFUND_WINDOW))))
+		}
+		// reversals that would only happen after the anchor have not happened yet
+		if sales[i].reversal != "" && !sales[i].reversedAt.Before(calendar.until) {
+			sales[i].reversal = ""
+		}
+		if sales[i].reversal != "" {
+			reversals++
+		}
 	}
-	defer conn.Close()
+	customers := visits(rng, sales, profile)
 
 	appender, err := duckdb.NewAppenderFromConn(conn, "", "transactions")
 	if err != nil {
-		return nil, fmt.Errorf("failed to establish appender for transactions: %w", err)
+		return nil, nil, fmt.Errorf("failed to establish appender for transactions: %w", err)
 	}
 	defer lg.WithField("quantity", amount).Info("flushing transactions to disk")
+	w.tracker.expect("transactions", amount+reversals)
 	defer appender.Close()
 
-	transactions := make([]uuid.UUID, amount)
-	now := time.Now()
-	for i := 0; i < amount; i++ {
-		transactions[i] = uuid.Must(uuid.NewRandom())
-		if err := appender.AppendRow(
-			duckdb.UUID(transactions[i]),
-			now.Add(-time.Duration(rand.Int())*time.Hour),
-			duckdb.UUID(merchantID),
-		); err != nil {
-			return nil, fmt.Errorf("failed to append transaction row: %w", err)
+	for _, sale := range sales {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if err := appendTransaction(appender, merchantID, transaction{
+			id:       sale.id,
+			at:       sale.at,
+			kind:     TRANSACTION_SALE,
+			customer: sale.customer,
+			location: &sale.location,
+		}); err != nil {
+			return nil, nil, err
+		}
+		w.wrote("transactions")
+	}
+
+	if err := appender.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to flush transactions: %w", err)
+	}
+	return sales, customers, nil
+}
+
+func (g *generator) customers(ctx context.Context, conn driver.Conn, lg *logrus.Logger, w *worker, merchantID uuid.UUID, customers []customer) error {
+	appender, err := duckdb.NewAppenderFromConn(conn, "", "customers")
+	if err != nil {
+		return fmt.Errorf("failed to establish appender for customers: %w", err)
+	}
+	defer lg.WithField("quantity", len(customers)).Info("flushing customers to disk")
+	w.tracker.expect("customers", len(customers))
+	defer appender.Close()
+
+	for _, c := range customers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := appender.AppendRow(duckdb.UUID(c.id), c.createdAt, duckdb.UUID(merchantID)); err != nil {
+			return fmt.Errorf("failed to append customer row: %w", err)
 		}
-		g.overall.Transactions++
-		reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTIONS, g.overall.Transactions)
+		w.wrote("customers")
 	}
 
-	return transactions, nil
+	if err := appender.Close(); err != nil {
+		return fmt.Errorf("failed to flush customers: %w", err)
+	}
+	return nil
 }
 
-func (g *generator) lines(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, merchantID uuid.UUID, products, transactions []uuid.UUID, amount int) ([]uuid.UUID, error) {
-	if len(products) == 0 || len(transactions) == 0 {
-		return nil, nil
+func (g *generator) lines(ctx context.Context, conn driver.Conn, lg *logrus.Logger, w *worker, rng *rand.Rand, merchantID uuid.UUID, products []product, sales []sale, profile profile) (int, error) {
+	if len(products) == 0 || len(sales) == 0 {
+		w.tracker.expect("transaction_lines", 0)
+		return 0, nil
 	}
 
-	conn, err := g.connector.Connect(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("could not connect: %w", err)
+	counts := make([]int, len(sales))
+	amount, reversed := 0, 0
+	for i, sale := range sales {
+		counts[i] = profile.LinesPerTransaction.pick(rng)
+		amount += counts[i]
+		switch sale.reversal {
+		case TRANSACTION_VOID:
+			reversed += counts[i]
+		case TRANSACTION_REFUND:
+			reversed++
+		}
 	}
-	defer conn.Close()
 
 	appender, err := duckdb.NewAppenderFromConn(conn, "", "transaction_lines")
 	if err != nil {
-		return nil, fmt.Errorf("failed to establish appender for transaction lines: %w", err)
+		return 0, fmt.Errorf("failed to establish appender for transaction lines: %w", err)
 	}
 	defer appender.Close()
 	defer lg.WithField("quantity", amount).Info("flushing transaction lines to disk")
+	w.tracker.expect("transaction_lines", amount+reversed)
+
+	popularity := newPopularity(rng, profile, len(products))
+	for i := range sales {
+		lines := make([]line, counts[i])
+		for j := range lines {
+			product := products[popularity.sample()]
+			lines[j] = line{
+				id:       uuid.Must(uuid.NewRandomFromReader(rng)),
+				product:  product.id,
+				quantity: quantity(rng, profile),
+			}
+			lines[j].amount = int64(product.price) * int64(lines[j].quantity)
+		}
+		basket(rng, profile, lines)
+		sales[i].payments = tender(rng, profile, total(lines))
+
+		for _, l := range lines {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			if err := appendLine(appender, sales[i].id, merchantID, l); err != nil {
+				return 0, err
+			}
+			w.wrote("transaction_lines")
+		}
+		if sales[i].reversal != "" {
+			sales[i].lines = lines
+		}
+	}
 
-	lines := make([]uuid.UUID, amount)
-	for i := 0; i < amount; i++ {
-		lines[i] = uuid.Must(uuid.NewRandom())
-		if err := appender.AppendRow(
-			duckdb.UUID(lines[i]),
-			duckdb.UUID(transactions[rand.Int()%len(transactions)]),
-			duckdb.UUID(products[rand.Int()%len(products)]),
-			int32(rand.Int()%13),
-			duckdb.UUID(merchantID),
-		); err != nil {
-			return nil, fmt.Errorf("failed to append transaction line row: %w", err)
+	if err := appender.Close(); err != nil {
+		return 0, fmt.Errorf("failed to flush transaction lines: %w", err)
+	}
+	return amount, nil
+}
+
+// adjustments writes the voids and refunds of the sales, a void reversing the
+// whole sale and a refund part of one of its lines.
+func (g *generator) adjustments(ctx context.Context, conn driver.Conn, lg *logrus.Logger, w *worker, rng *rand.Rand, merchantID uuid.UUID, sales []sale) (int, int, error) {
+	transactions, err := duckdb.NewAppenderFromConn(conn, "", "transactions")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to establish appender for transactions: %w", err)
+	}
+	defer transactions.Close()
+
+	lines, err := duckdb.NewAppenderFromConn(conn, "", "transaction_lines")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to establish appender for transaction lines: %w", err)
+	}
+	defer lines.Close()
+
+	reversals, reversed := 0, 0
+	defer func() {
+		lg.WithFields(logrus.Fields{"transactions": reversals, "lines": reversed}).Info("flushing adjustments to disk")
+	}()
+
+	for i, sale := range sales {
+		if sale.reversal == "" || len(sale.lines) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, 0, err
+		}
+
+		id := uuid.Must(uuid.NewRandomFromReader(rng))
+		if err := appendTransaction(transactions, merchantID, transaction{
+			id:       id,
+			at:       sale.reversedAt,
+			kind:     sale.reversal,
+			original: &sale.id,
+			customer: sale.customer,
+			location: &sale.location,
+		}); err != nil {
+			return 0, 0, err
+		}
+		reversals++
+		w.wrote("transactions")
+
+		undone := sale.lines
+		if sale.reversal == TRANSACTION_REFUND {
+			undone = []line{sale.lines[rng.Intn(len(sale.lines))]}
+		}
+		reversal := make([]line, len(undone))
+		for j, l := range undone {
+			units := l.quantity
+			if sale.reversal == TRANSACTION_REFUND {
+				units = 1 + rng.Intn(l.quantity)
+			}
+			reversal[j] = l.reverse(uuid.Must(uuid.NewRandomFromReader(rng)), units)
+			if err := appendLine(lines, id, merchantID, reversal[j]); err != nil {
+				return 0, 0, err
+			}
+			reversed++
+			w.wrote("transaction_lines")
+		}
+		sales[i].reversedBy, sales[i].paidBack = id, total(reversal)
+	}
+
+	if err := transactions.Close(); err != nil {
+		return 0, 0, fmt.Errorf("failed to flush transactions: %w", err)
+	}
+	if err := lines.Close(); err != nil {
+		return 0, 0, fmt.Errorf("failed to flush transaction lines: %w", err)
+	}
+	return reversals, reversed, nil
+}
+
+// payments writes how the sales were paid, voids and refunds paying back to the
+// tender the sale was first paid with.
+func (g *generator) payments(ctx context.Context, conn driver.Conn, lg *logrus.Logger, w *worker, rng *rand.Rand, merchantID uuid.UUID, sales []sale) error {
+	amount := 0
+	for _, sale := range sales {
+		amount += len(sale.payments)
+		if sale.reversedBy != uuid.Nil {
+			amount++
 		}
-		g.overall.Lines++
-		reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTION_LINES, g.overall.Lines)
 	}
 
-	return lines, nil
+	appender, err := duckdb.NewAppenderFromConn(conn, "", "payments")
+	if err != nil {
+		return fmt.Errorf("failed to establish appender for payments: %w", err)
+	}
+	defer lg.WithField("quantity", amount).Info("flushing payments to disk")
+	w.tracker.expect("payments", amount)
+	defer appender.Close()
+
+	for _, sale := range sales {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, p := range sale.payments {
+			if err := appendPayment(appender, uuid.Must(uuid.NewRandomFromReader(rng)), sale.id, merchantID, p); err != nil {
+				return err
+			}
+			w.wrote("payments")
+		}
+		if sale.reversedBy != uuid.Nil {
+			back := payment{tender: sale.payments[0].tender, amount: sale.paidBack}
+			if err := appendPayment(appender, uuid.Must(uuid.NewRandomFromReader(rng)), sale.reversedBy, merchantID, back); err != nil {
+				return err
+			}
+			w.wrote("payments")
+		}
+	}
+
+	if err := appender.Close(); err != nil {
+		return fmt.Errorf("failed to flush payments: %w", err)
+	}
+	return nil
+}
+
+// transaction is a transactions row. Original is the sale undone by voids and
+// refunds, customer is nil for anonymous transactions and location for ones
+// made nowhere in particular.
+type transaction struct {
+	id       uuid.UUID
+	at       time.Time
+	kind     string
+	original *uuid.UUID
+	customer *uuid.UUID
+	location *uuid.UUID
+}
+
+func appendTransaction(appender *duckdb.Appender, merchantID uuid.UUID, t transaction) error {
+	nullable := func(id *uuid.UUID) any {
+		if id == nil {
+			return nil
+		}
+		return duckdb.UUID(*id)
+	}
+	if err := appender.AppendRow(
+		duckdb.UUID(t.id),
+		t.at,
+		duckdb.UUID(merchantID),
+		t.kind,
+		nullable(t.original),
+		nullable(t.customer),
+		nullable(t.location),
+	); err != nil {
+		return fmt.Errorf("failed to append transaction row: %w", err)
+	}
+	return nil
+}
+
+func appendLine(appender *duckdb.Appender, transactionID, merchantID uuid.UUID, l line) error {
+	if err := appender.AppendRow(
+		duckdb.UUID(l.id),
+		duckdb.UUID(transactionID),
+		duckdb.UUID(l.product),
+		int32(l.quantity),
+		duckdb.UUID(merchantID),
+		l.discount,
+		l.orderDiscount,
+		l.tax,
+	); err != nil {
+		return fmt.Errorf("failed to append transaction line row: %w", err)
+	}
+	return nil
 }
@@ -3,35 +3,717 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/suessflorian/client-side-analytics/forecast"
 	"github.com/suessflorian/client-side-analytics/middleware"
+	"github.com/suessflorian/client-side-analytics/semantic"
 	"github.com/suessflorian/client-side-analytics/telemetry"
 )
 
 type handler struct {
 	generator *generator
+	jobs      *jobs
+	simulator *simulator
 	analytics *analytics
 }
 
+type generateRequest struct {
+	// Seed reproduces a previous generation, a random one is picked if omitted.
+	Seed *int64 `json:"seed"`
+	// Until anchors the generated timestamps, defaulting to the start of today.
+	Until *time.Time `json:"until"`
+	// Preset names the base profile, DEFAULT_PRESET when omitted.
+	Preset string `json:"preset"`
+	// Profile overrides individual fields of the preset.
+	Profile json.RawMessage `json:"profile"`
+	// Bulk generates inside DuckDB for volume, at the cost of reproducibility.
+	Bulk bool `json:"bulk"`
+}
+
+func (req generateRequest) generation() (generation, error) {
+	profile, err := resolveProfile(req.Preset, req.Profile)
+	if err != nil {
+		return generation{}, err
+	}
+
+	params := generation{
+		Seed:    rand.Int63(),
+		Until:   time.Now().UTC().Truncate(24 * time.Hour),
+		Profile: profile,
+		Bulk:    req.Bulk,
+	}
+	if req.Seed != nil {
+		params.Seed = *req.Seed
+	}
+	if req.Until != nil {
+		params.Until = req.Until.UTC()
+	}
+	return params, nil
+}
+
 func (h *handler) generateHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	generated, err := h.generator.create(ctx, lg(ctx), reporter(ctx), rand.Int()%10)
+
+	var req generateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		lg(ctx).WithError(err).Error("invalid generate request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	params, err := req.generation()
+	if err != nil {
+		lg(ctx).WithError(err).Error("invalid generation profile")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := h.generator.checkSeed(ctx, params); errors.Is(err, ErrMerchantExists) {
+		lg(ctx).WithError(err).WithField("seed", params.Seed).Error("seed already generated")
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		lg(ctx).WithError(err).Error("failed to check seed")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	job := h.jobs.start(lg(ctx), reporter(ctx), params)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.id.String())
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job.status())
+
+	lg(ctx).WithFields(logrus.Fields{"job": job.id, "seed": params.Seed}).Info("started merchant generation")
+}
+
+func (h *handler) jobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		lg(ctx).Error("invalid job uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	job, err := h.jobs.get(id)
+	if err != nil {
+		lg(ctx).WithError(err).WithField("job", id).Error("failed to get job")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job.status())
+}
+
+func (h *handler) cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		lg(ctx).Error("invalid job uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("job", id)
+
+	job, err := h.jobs.get(id)
+	if err != nil {
+		lg.WithError(err).Error("failed to get job")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := job.stop(ctx); err != nil {
+		lg.WithError(err).Error("failed to wait for job cancellation")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job.status())
+
+	lg.Info("cancelled merchant generation")
+}
+
+type simulateRequest struct {
+	Merchants []uuid.UUID `json:"merchants"`
+	// TPS is the average transactions per second over a day.
+	TPS float64 `json:"tps"`
+	// Diurnal is how far traffic swings around the average over the day, from 0
+	// for flat traffic to 1 for none at night. DEFAULT_DIURNAL when omitted.
+	Diurnal *float64 `json:"diurnal"`
+	// Preset and Profile shape baskets like they do for generation.
+	Preset  string          `json:"preset"`
+	Profile json.RawMessage `json:"profile"`
+}
+
+func (req simulateRequest) simulation() (simulationParams, error) {
+	profile, err := resolveProfile(req.Preset, req.Profile)
+	if err != nil {
+		return simulationParams{}, err
+	}
+
+	params := simulationParams{
+		Merchants: req.Merchants,
+		TPS:       req.TPS,
+		Diurnal:   DEFAULT_DIURNAL,
+		Profile:   profile,
+	}
+	if req.Diurnal != nil {
+		params.Diurnal = *req.Diurnal
+	}
+	return params, params.validate()
+}
+
+func (h *handler) startSimulatorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req simulateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg(ctx).WithError(err).Error("invalid simulate request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	params, err := req.simulation()
+	if err != nil {
+		lg(ctx).WithError(err).Error("invalid simulation")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sim, err := h.simulator.start(ctx, lg(ctx), reporter(ctx), params)
+	if errors.Is(err, ErrInvalidSimulation) {
+		lg(ctx).WithError(err).Error("invalid simulation")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	} else if errors.Is(err, ErrSimulatorRunning) {
+		lg(ctx).WithError(err).Error("failed to start simulator")
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		lg(ctx).WithError(err).Error("failed to start simulator")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(sim.status())
+
+	lg(ctx).WithFields(logrus.Fields{"merchants": len(params.Merchants), "tps": params.TPS}).Info("started traffic simulation")
+}
+
+func (h *handler) simulatorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	sim, err := h.simulator.get()
+	if err != nil {
+		lg(ctx).WithError(err).Error("failed to get simulator")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sim.status())
+}
+
+func (h *handler) stopSimulatorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	sim, err := h.simulator.stop(ctx)
+	if errors.Is(err, ErrSimulatorIdle) {
+		lg(ctx).WithError(err).Error("failed to stop simulator")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		lg(ctx).WithError(err).Error("failed to wait for simulator to stop")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sim.status())
+
+	lg(ctx).Info("stopped traffic simulation")
+}
+
+// DEFAULT_IMPORT_NAME names imported merchants when the upload does not.
+const DEFAULT_IMPORT_NAME = "Imported merchant"
+
+func (h *handler) importHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = DEFAULT_IMPORT_NAME
+	}
+
+	imported, err := h.generator.importArchive(ctx, lg(ctx), reporter(ctx), http.MaxBytesReader(w, r.Body, MAX_IMPORT_BYTES), name)
+	var invalid *ImportError
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &invalid) {
+		lg(ctx).WithError(err).Error("invalid import")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(invalid)
+		return
+	} else if errors.As(err, &tooLarge) {
+		lg(ctx).WithError(err).Error("import too large")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		lg(ctx).WithError(err).Error("failed to import merchant")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(imported)
+
+	lg(ctx).WithField("merchant", imported.Merchant.ID).Info("imported merchant")
+}
+
+// MERCHANTS_PAGE is how many merchants a page lists unless asked otherwise.
+const MERCHANTS_PAGE = 50
+
+func (h *handler) merchantsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	limit, err := boundedParam(r, "limit", MERCHANTS_PAGE, 1, 500)
+	if err != nil {
+		lg(ctx).WithError(err).Error("invalid page size")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sort := r.URL.Query().Get("sort")
+	if sort == "" {
+		sort = "name"
+	}
+	if _, ok := merchantSorts[sort]; !ok {
+		lg(ctx).WithField("sort", sort).Error("invalid merchant sort")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.analytics.ListMerchants(ctx, r.URL.Query().Get("q"), sort, r.URL.Query().Get("cursor"), limit)
+	if errors.Is(err, ErrInvalidCursor) {
+		lg(ctx).WithError(err).Error("invalid merchant cursor")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		lg(ctx).WithError(err).Error("failed to list merchants")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(page)
+	if err != nil {
+		lg(ctx).WithError(err).Error("failed to marshal merchants")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg(ctx).WithField("merchants", len(page.Merchants)).Info("served merchants")
+}
+
+func (h *handler) merchantHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).WithError(err).Error("invalid merchant_id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	merchant, err := h.analytics.GetMerchant(ctx, merchantID)
+	if errors.Is(err, ErrUnknownMerchant) {
+		lg.WithError(err).Error("failed to get merchant")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		lg.WithError(err).Error("failed to get merchant")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(merchant)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal merchant")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant")
+}
+
+func (h *handler) deleteMerchantHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).WithError(err).Error("invalid merchant_id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	var erasure Erasure
+	err = h.simulator.exclusively(merchantID, func() (err error) {
+		erasure, err = h.generator.erase(ctx, reporter(ctx), merchantID)
+		return err
+	})
+	if errors.Is(err, ErrUnknownMerchant) {
+		lg.WithError(err).Error("failed to erase merchant")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrMerchantSimulated) {
+		lg.WithError(err).Error("failed to erase merchant")
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		lg.WithError(err).Error("failed to erase merchant")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(erasure)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal erasure receipt")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.WithFields(logrus.Fields{"receipt": erasure.ID, "rows": erasure.Rows}).Info("erased merchant")
+}
+
+// integrityHandler reports integrity violations on GET, and on POST fixes them
+// as the mode parameter says.
+func (h *handler) integrityHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	mode := INTEGRITY_REPORT
+	if r.Method == http.MethodPost {
+		mode = r.URL.Query().Get("mode")
+	}
+	if !integrityModes[mode] {
+		lg(ctx).WithField("mode", mode).Error("invalid integrity mode")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	samples, err := boundedParam(r, "samples", INTEGRITY_SAMPLES, 0, 100)
+	if err != nil {
+		lg(ctx).WithError(err).Error("invalid sample size")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.generator.checkIntegrity(ctx, lg(ctx), reporter(ctx), mode, samples)
+	if err != nil {
+		lg(ctx).WithError(err).Error("failed to check integrity")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		lg(ctx).WithError(err).Error("failed to marshal integrity report")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg(ctx).WithFields(logrus.Fields{"mode": mode, "violations": len(report.Violations)}).Info("checked integrity")
+}
+
+func (h *handler) analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	top, err := h.analytics.GetTopProducts(ctx, merchantID, locations)
+	if err != nil {
+		lg.WithError(err).Error("failed to get top products")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(top)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal top products")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant analytics")
+}
+
+func (h *handler) retentionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cohorts, err := h.analytics.GetRetentionCohorts(ctx, merchantID, locations)
+	if err != nil {
+		lg.WithError(err).Error("failed to get retention cohorts")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(cohorts)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal retention cohorts")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant retention cohorts")
+}
+
+func (h *handler) lifetimeValueHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	value, err := h.analytics.GetLifetimeValue(ctx, merchantID, locations)
+	if err != nil {
+		lg.WithError(err).Error("failed to get customer lifetime value")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(value)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal customer lifetime value")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant customer lifetime value")
+}
+
+func (h *handler) customerSplitHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	split, err := h.analytics.GetCustomerSplit(ctx, merchantID, locations)
+	if err != nil {
+		lg.WithError(err).Error("failed to get new versus returning revenue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(split)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal new versus returning revenue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant new versus returning revenue")
+}
+
+func (h *handler) categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	categories, err := h.analytics.GetCategoryRevenue(ctx, merchantID, locations)
+	if err != nil {
+		lg.WithError(err).Error("failed to get category revenue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(categories)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal category revenue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant category revenue")
+}
+
+func (h *handler) locationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	revenue, err := h.analytics.GetLocationRevenue(ctx, merchantID, locations)
+	if err != nil {
+		lg.WithError(err).Error("failed to get location revenue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(revenue)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal location revenue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant location revenue")
+}
+
+func (h *handler) tendersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "month"
+	}
+	if !tenderIntervals[interval] {
+		lg.WithField("interval", interval).Error("invalid tender mix interval")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	mix, err := h.analytics.GetTenderMix(ctx, merchantID, locations, interval)
+	if err != nil {
+		lg.WithError(err).Error("failed to get tender mix")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(mix)
 	if err != nil {
-		lg(ctx).WithError(err).Error("failed to generate artefacts")
+		lg.WithError(err).Error("failed to marshal tender mix")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(generated)
 
-	lg(ctx).Info("generated merchant data")
+	lg.Info("served merchant tender mix")
 }
 
-func (h *handler) analyticsHandler(w http.ResponseWriter, r *http.Request) {
+// INVENTORY_DAYS is the default window of trade stock is measured against,
+// STOCKOUT_DAYS how soon a product must run out to count as running out.
+const (
+	INVENTORY_DAYS = 30
+	STOCKOUT_DAYS  = 7
+)
+
+func (h *handler) inventoryHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
@@ -42,22 +724,370 @@ func (h *handler) analyticsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	lg := lg(ctx).WithField("merchant", merchantID)
 
-	top, err := h.analytics.GetTopProducts(ctx, merchantID)
+	locations, err := locationsParam(r)
 	if err != nil {
-		lg.WithError(err).Error("failed to get top products")
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	days, err := boundedParam(r, "days", INVENTORY_DAYS, 1, 365)
+	if err != nil {
+		lg.WithError(err).Error("invalid inventory window")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	inventory, err := h.analytics.GetInventory(ctx, merchantID, locations, days)
+	if err != nil {
+		lg.WithError(err).Error("failed to get inventory")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(top)
+	err = json.NewEncoder(w).Encode(inventory)
 	if err != nil {
-		lg.WithError(err).Error("failed to marshal top products")
+		lg.WithError(err).Error("failed to marshal inventory")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	lg.Info("served merchant analytics")
+	lg.Info("served merchant inventory")
+}
+
+func (h *handler) stockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	days, err := boundedParam(r, "days", INVENTORY_DAYS, 1, 365)
+	if err != nil {
+		lg.WithError(err).Error("invalid inventory window")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	within, err := boundedParam(r, "within", STOCKOUT_DAYS, 0, 365)
+	if err != nil {
+		lg.WithError(err).Error("invalid stockout horizon")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	inventory, err := h.analytics.GetStockouts(ctx, merchantID, locations, days, within)
+	if err != nil {
+		lg.WithError(err).Error("failed to get stockouts")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(inventory)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal stockouts")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant stockouts")
+}
+
+// confidenceQuantiles maps supported prediction interval levels to the standard
+// normal quantile used to size them.
+var confidenceQuantiles = map[string]float64{
+	"0.8":  1.282,
+	"0.9":  1.645,
+	"0.95": 1.960,
+	"0.99": 2.576,
+}
+
+type revenueForecast struct {
+	Model    *forecast.Model `json:"model"`
+	History  []DailyRevenue  `json:"history"`
+	Forecast []forecastDay   `json:"forecast"`
+}
+
+type forecastDay struct {
+	Day time.Time `json:"day"`
+	forecast.Point
+}
+
+func (h *handler) forecastHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	days := 14
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		days, err = strconv.Atoi(raw)
+		if err != nil || days < 1 || days > 365 {
+			lg.Error("invalid forecast horizon")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	confidence := r.URL.Query().Get("confidence")
+	if confidence == "" {
+		confidence = "0.95"
+	}
+	z, ok := confidenceQuantiles[confidence]
+	if !ok {
+		lg.Error("unsupported forecast confidence level")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	history, err := h.analytics.GetDailyRevenue(ctx, merchantID, locations)
+	if err != nil {
+		lg.WithError(err).Error("failed to get daily revenue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// only the trailing year is relevant to a short term forecast
+	if len(history) > 365 {
+		history = history[len(history)-365:]
+	}
+
+	series := make([]float64, len(history))
+	for i, day := range history {
+		series[i] = day.Revenue
+	}
+
+	model, err := forecast.Fit(series, 7)
+	if errors.Is(err, forecast.ErrInsufficientData) {
+		lg.WithError(err).Info("not enough revenue history to forecast")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		lg.WithError(err).Error("failed to fit forecast model")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := revenueForecast{Model: model, History: history}
+	last := history[len(history)-1].Day
+	for i, point := range model.Forecast(days, z) {
+		point.Lower = max(point.Lower, 0)
+		point.Value = max(point.Value, 0)
+		res.Forecast = append(res.Forecast, forecastDay{Day: last.AddDate(0, 0, i+1), Point: point})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal revenue forecast")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant revenue forecast")
+}
+
+func (h *handler) pivotHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	query := r.URL.Query()
+	req := pivotRequest{
+		Dimensions: query["dimension"],
+		Measures:   query["measure"],
+		Subtotals:  query.Get("subtotals"),
+	}
+	for key, bound := range map[string]*time.Time{"from": &req.From, "to": &req.To} {
+		if raw := query.Get(key); raw != "" {
+			if *bound, err = time.Parse(time.DateOnly, raw); err != nil {
+				lg.WithError(err).Errorf("invalid %s date", key)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	for _, raw := range query["product"] {
+		product, err := uuid.Parse(raw)
+		if err != nil {
+			lg.WithError(err).Error("invalid product uuid")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Products = append(req.Products, product)
+	}
+	for _, raw := range query["category"] {
+		category, err := uuid.Parse(raw)
+		if err != nil {
+			lg.WithError(err).Error("invalid category uuid")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Categories = append(req.Categories, category)
+	}
+	if req.Locations, err = locationsParam(r); err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.analytics.Pivot(ctx, merchantID, req)
+	if errors.Is(err, ErrInvalidPivot) {
+		lg.WithError(err).Error("invalid pivot request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		lg.WithError(err).Error("failed to pivot merchant analytics")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal pivot")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served merchant pivot")
+}
+
+func (h *handler) queryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	merchantID, err := uuid.Parse(r.PathValue("merchant_id"))
+	if err != nil {
+		lg(ctx).Error("invalid merchant_id uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lg := lg(ctx).WithField("merchant", merchantID)
+
+	var query semantic.Query
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		lg.WithError(err).Error("invalid semantic query body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	locations, err := locationsParam(r)
+	if err != nil {
+		lg.WithError(err).Error("invalid location uuid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(locations) > 0 {
+		values := make([]any, len(locations))
+		for i, location := range locations {
+			values[i] = location.String()
+		}
+		query.Filters = append(query.Filters, semantic.Filter{Field: "location.id", Operator: "in", Values: values})
+	}
+
+	res, err := h.analytics.Query(ctx, merchantID, query)
+	if errors.Is(err, semantic.ErrInvalidQuery) {
+		lg.WithError(err).Error("invalid semantic query")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		lg.WithError(err).Error("failed to run semantic query")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		lg.WithError(err).Error("failed to marshal semantic query result")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info("served semantic query")
+}
+
+func (h *handler) catalogueHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metrics.Catalogue()); err != nil {
+		lg(ctx).WithError(err).Error("failed to marshal semantic catalogue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// compileHandler hands out the SQL of a semantic query so that clients can run
+// it against their local copy of a merchant.
+func (h *handler) compileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	target, err := semantic.TargetByName(r.URL.Query().Get("target"))
+	if err != nil {
+		lg(ctx).WithError(err).Error("invalid compile target")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var merchantID uuid.UUID
+	if target.Scoped {
+		merchantID, err = uuid.Parse(r.URL.Query().Get("merchant_id"))
+		if err != nil {
+			lg(ctx).Error("invalid merchant_id uuid")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var query semantic.Query
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		lg(ctx).WithError(err).Error("invalid semantic query body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	compiled, err := metrics.Compile(query, target, merchantID)
+	if err != nil {
+		lg(ctx).WithError(err).Error("invalid semantic query")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(compiled); err != nil {
+		lg(ctx).WithError(err).Error("failed to marshal compiled query")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
 func (h *handler) loaderHandler(w http.ResponseWriter, r *http.Request) {
@@ -71,11 +1101,24 @@ func (h *handler) loaderHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	lg := lg(ctx).WithField("merchant", merchantID)
 
+	// a single location's export carries only that location's transactions
+	var location *uuid.UUID
+	if raw := r.URL.Query().Get("location"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			lg.WithError(err).Error("invalid location uuid")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		location = &id
+		lg = lg.WithField("location", id)
+	}
+
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", "attachment;filename=data.zip")
 
 	lg.Info("streaming merchant data")
-	err = h.analytics.csvDump(ctx, w, merchantID)
+	err = h.analytics.csvDump(ctx, w, merchantID, location)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		lg.WithError(err).Error("failed to dump data")
@@ -85,6 +1128,37 @@ func (h *handler) loaderHandler(w http.ResponseWriter, r *http.Request) {
 	lg.Info("streaming finished streaming")
 }
 
+// locationsParam reads the locations an analytics request is narrowed to, the
+// location parameter being repeatable. None means all of them.
+func locationsParam(r *http.Request) ([]uuid.UUID, error) {
+	var res []uuid.UUID
+	for _, raw := range r.URL.Query()["location"] {
+		location, err := uuid.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, location)
+	}
+	return res, nil
+}
+
+// boundedParam reads an integer query parameter within [lo, hi], fallback
+// when left out.
+func boundedParam(r *http.Request, name string, fallback, lo, hi int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, err
+	}
+	if value < lo || value > hi {
+		return 0, fmt.Errorf("%s must lie within [%d, %d]", name, lo, hi)
+	}
+	return value, nil
+}
+
 func lg(ctx context.Context) *logrus.Logger {
 	return middleware.ContextUtils(ctx).Logger
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	"github.com/suessflorian/client-side-analytics/forecast/forecasttest"
+	"github.com/suessflorian/client-side-analytics/middleware"
+	store "github.com/suessflorian/client-side-analytics/store/duckdb"
+	"github.com/suessflorian/client-side-analytics/telemetry"
+)
+
+var update = flag.Bool("update", false, "rewrite test fixtures from the generator")
+
+// revenueFixture is shared with the forecast package tests, which fit it.
+const revenueFixture = "forecast/testdata/seeded_revenue.json"
+
+func quiet() (*logrus.Logger, *telemetry.Reporter) {
+	lg := logrus.New()
+	lg.SetOutput(io.Discard)
+	_, reporter := telemetry.New(context.Background(), lg)
+	return lg, reporter
+}
+
+// emptyStore migrates a fresh database in a scratch directory.
+func emptyStore(t *testing.T) *generator {
+	t.Helper()
+
+	ctx := context.Background()
+	lg, reporter := quiet()
+
+	connector, err := store.Init(ctx, lg, filepath.Join(t.TempDir(), DATABASE))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { connector.Close() })
+
+	g, err := newMerchantGenerator(ctx, lg, reporter, connector, 1)
+	if err != nil {
+		t.Fatalf("failed to start generator: %v", err)
+	}
+	return g
+}
+
+// seededStore generates a fresh database in a scratch directory and returns it
+// with the first merchant the seed drew.
+func seededStore(t *testing.T, seed int64, preset, until string) (*duckdb.Connector, uuid.UUID) {
+	t.Helper()
+
+	ctx := context.Background()
+	lg, reporter := quiet()
+	g := emptyStore(t)
+
+	anchor, err := time.Parse(time.DateOnly, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := generateRequest{Seed: &seed, Until: &anchor, Preset: preset}.generation()
+	if err != nil {
+		t.Fatalf("invalid generation: %v", err)
+	}
+	generated, err := g.create(ctx, lg, reporter, params, nil)
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+	return g.connector, generated.Merchants[0].ID
+}
+
+// TestSeededRevenueFixture regenerates the merchant behind the forecast
+// fixture, so the forecast tests keep fitting what the generator produces.
+func TestSeededRevenueFixture(t *testing.T) {
+	want := forecasttest.Seeded{Seed: 42, Preset: "tiny", Until: "2026-01-01"}
+	if !*update {
+		var err error
+		if want, err = forecasttest.Load(revenueFixture); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connector, merchantID := seededStore(t, want.Seed, want.Preset, want.Until)
+	history, err := (&analytics{connector}).GetDailyRevenue(context.Background(), merchantID, nil)
+	if err != nil {
+		t.Fatalf("failed to get daily revenue: %v", err)
+	}
+	revenue := make([]float64, len(history))
+	for i, day := range history {
+		revenue[i] = day.Revenue
+	}
+
+	if *update {
+		want.Revenue = revenue
+		if err := want.Write(revenueFixture); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if !slices.Equal(revenue, want.Revenue) {
+		t.Errorf("seed %d generates %d days of revenue differing from the fixture's %d, rerun with -update if intended", want.Seed, len(revenue), len(want.Revenue))
+	}
+}
+
+func forecastRequest(h *handler, merchantID uuid.UUID, confidence string) *httptest.ResponseRecorder {
+	lg, reporter := quiet()
+	r := httptest.NewRequest(http.MethodGet, "/analytics/"+merchantID.String()+"/forecast?confidence="+confidence, nil)
+	r.SetPathValue("merchant_id", merchantID.String())
+	w := httptest.NewRecorder()
+	middleware.WithContextUtils(h.forecastHandler, lg, reporter)(w, r)
+	return w
+}
+
+func TestForecastConfidenceWidensInterval(t *testing.T) {
+	connector, merchantID := seededStore(t, 42, "tiny", "2026-01-01")
+	h := &handler{analytics: &analytics{connector}}
+
+	// the upper bound is never clamped, so its distance from the forecast
+	// grows with the confidence level's quantile
+	var previous []forecastDay
+	for _, confidence := range []string{"0.8", "0.9", "0.95", "0.99"} {
+		w := forecastRequest(h, merchantID, confidence)
+		if w.Code != http.StatusOK {
+			t.Fatalf("confidence %s: status = %d, want %d", confidence, w.Code, http.StatusOK)
+		}
+		var res revenueForecast
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("confidence %s: failed to decode forecast: %v", confidence, err)
+		}
+
+		for i, day := range res.Forecast {
+			if previous != nil && day.Upper <= previous[i].Upper {
+				t.Errorf("confidence %s: upper bound of %s is %.2f, not above %.2f at the lower confidence", confidence, day.Day.Format(time.DateOnly), day.Upper, previous[i].Upper)
+			}
+		}
+		previous = res.Forecast
+	}
+
+	first := previous[0]
+	if first.Value > 0 {
+		// half widths scale with the quantiles of 0.99 and 0.8
+		w := forecastRequest(h, merchantID, "0.8")
+		var narrow revenueForecast
+		if err := json.NewDecoder(w.Body).Decode(&narrow); err != nil {
+			t.Fatal(err)
+		}
+		got := (first.Upper - first.Value) / (narrow.Forecast[0].Upper - narrow.Forecast[0].Value)
+		if want := 2.576 / 1.282; math.Abs(got-want) > 1e-9 {
+			t.Errorf("0.99 interval is %.6f times the 0.8 one, want %.6f", got, want)
+		}
+	}
+}
+
+func TestForecastHandlerRejectsUnsupportedConfidence(t *testing.T) {
+	h := &handler{}
+	for _, confidence := range []string{"0.950", ".95", "95", "0.5", "high"} {
+		if w := forecastRequest(h, uuid.New(), confidence); w.Code != http.StatusBadRequest {
+			t.Errorf("confidence %q: status = %d, want %d", confidence, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/suessflorian/client-side-analytics/telemetry"
+)
+
+// MAX_IMPORT_BYTES caps the size of an uploaded archive.
+const MAX_IMPORT_BYTES = 1 << 30
+
+// IMPORT_MAPPING is the optional file of an archive describing its layout.
+const IMPORT_MAPPING = "mapping.json"
+
+// MAX_IMPORT_SAMPLES caps how many offending values are listed per problem.
+const MAX_IMPORT_SAMPLES = 5
+
+var ErrInvalidImport = errors.New("invalid import")
+
+// ImportError lists everything wrong with an archive at once, so an upload can
+// be fixed in one go.
+type ImportError struct {
+	Problems []string `json:"problems"`
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidImport, strings.Join(e.Problems, "; "))
+}
+
+func (e *ImportError) Unwrap() error {
+	return ErrInvalidImport
+}
+
+// references lists the foreign keys between merchant tables by column, the
+// schema leaves them undeclared.
+var references = map[string]map[string]string{
+	"categories": {
+		"parent_id": "categories",
+	},
+	"products": {
+		"category_id": "categories",
+	},
+	"transactions": {
+		"original_transaction_id": "transactions",
+		"customer_id":             "customers",
+		"location_id":             "locations",
+	},
+	"transaction_lines": {
+		"transaction_id": "transactions",
+		"product_id":     "products",
+	},
+	"payments": {
+		"transaction_id": "transactions",
+	},
+	"stock_movements": {
+		"product_id":          "products",
+		"location_id":         "locations",
+		"transaction_line_id": "transaction_lines",
+	},
+}
+
+// importMapping maps an archive's own layout onto the merchant tables, tables
+// and columns left out are expected under the names csvDump gives them.
+type importMapping map[string]struct {
+	File    string            `json:"file"`
+	Columns map[string]string `json:"columns"`
+}
+
+type Imported struct {
+	Merchant Merchant         `json:"merchant"`
+	Rows     map[string]int64 `json:"rows"`
+}
+
+type columnInfo struct {
+	name     string
+	dataType string
+	// optional columns have a default to fall back on, so archives predating
+	// them still import.
+	optional bool
+}
+
+// staged is a merchant table read from the archive into a temporary table of
+// the same column names, values still being as found in the file.
+type staged struct {
+	table   tableInfo
+	columns []columnInfo
+	file    string
+}
+
+func (s staged) temp() string {
+	return "import_" + s.table.Name
+}
+
+func (s staged) keys() string {
+	return "import_" + s.table.Name + "_keys"
+}
+
+// importArchive loads a zip of CSV or Parquet files as a new merchant. Every row
+// gets a fresh id, references being resolved through the ids of the archive, so
+// the archive's ids need not be UUIDs nor unique across merchants.
+func (g *generator) importArchive(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, archive io.Reader, name string) (Imported, error) {
+	dir, err := os.MkdirTemp("", "import-*")
+	if err != nil {
+		return Imported{}, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, mapping, err := unpack(archive, dir)
+	if err != nil {
+		return Imported{}, err
+	}
+
+	conn, err := sql.OpenDB(g.connector).Conn(ctx)
+	if err != nil {
+		return Imported{}, fmt.Errorf("could not connect: %w", err)
+	}
+	defer conn.Close()
+
+	tables, err := stage(ctx, conn, files, mapping)
+	defer func() {
+		for _, table := range tables {
+			_, _ = conn.ExecContext(context.Background(), fmt.Sprintf("DROP TABLE IF EXISTS %s;", table.temp()))
+			_, _ = conn.ExecContext(context.Background(), fmt.Sprintf("DROP TABLE IF EXISTS %s;", table.keys()))
+		}
+	}()
+	if err != nil {
+		return Imported{}, err
+	}
+	if err := validate(ctx, conn, tables); err != nil {
+		return Imported{}, err
+	}
+
+	res := Imported{
+		Merchant: Merchant{ID: uuid.New(), Name: name},
+		Rows:     make(map[string]int64),
+	}
+	if err := atomically(ctx, conn, func() error {
+		if _, err := conn.ExecContext(ctx, `
+            INSERT INTO main.merchants (id, name) VALUES (?, ?);
+        `, res.Merchant.ID, res.Merchant.Name); err != nil {
+			return fmt.Errorf("failed to insert merchant row: %w", err)
+		}
+
+		for _, table := range tables {
+			inserted, err := load(ctx, conn, table, tables, res.Merchant.ID)
+			if err != nil {
+				return err
+			}
+			res.Rows[table.table.Name] = inserted
+			lg.WithFields(logrus.Fields{"quantity": inserted, "file": table.file}).Infof("imported %s", table.table.Name)
+		}
+
+		// archives without payments have their transactions settled on import
+		if _, err := settleUnpaid(ctx, conn, res.Merchant.ID); err != nil {
+			return err
+		}
+
+		// archives predating stock tracking have their sales booked on import
+		if _, err := recordSales(ctx, conn, res.Merchant.ID, time.Time{}); err != nil {
+			return err
+		}
+		if err := refreshStock(ctx, conn, res.Merchant.ID, nil); err != nil {
+			return err
+		}
+
+		return refreshRollups(ctx, conn, res.Merchant.ID, time.Time{}, nil)
+	}); err != nil {
+		return Imported{}, err
+	}
+
+	if err := g.recount(ctx, reporter); err != nil {
+		lg.WithError(err).Error("failed to recount entities after import")
+	}
+	return res, nil
+}
+
+// unpack extracts the archive's data files into dir by base name, reading the
+// mapping if there is one.
+func unpack(archive io.Reader, dir string) (map[string]string, importMapping, error) {
+	upload := filepath.Join(dir, "upload.zip")
+	file, err := os.Create(upload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to buffer upload: %w", err)
+	}
+	_, err = io.Copy(file, archive)
+	file.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to buffer upload: %w", err)
+	}
+
+	reader, err := zip.OpenReader(upload)
+	if err != nil {
+		return nil, nil, &ImportError{Problems: []string{fmt.Sprintf("not a zip archive: %v", err)}}
+	}
+	defer reader.Close()
+
+	if err := os.Mkdir(filepath.Join(dir, "files"), 0o700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+
+	files := make(map[string]string)
+	var mapping importMapping
+	for _, entry := range reader.File {
+		base := filepath.Base(entry.Name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		switch filepath.Ext(base) {
+		case ".csv", ".parquet":
+			path := filepath.Join(dir, "files", base)
+			if err := extract(entry, path); err != nil {
+				return nil, nil, err
+			}
+			files[base] = path
+		case ".json":
+			if base != IMPORT_MAPPING {
+				continue
+			}
+			src, err := entry.Open()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to open %s in archive: %w", IMPORT_MAPPING, err)
+			}
+			err = json.NewDecoder(src).Decode(&mapping)
+			src.Close()
+			if err != nil {
+				return nil, nil, &ImportError{Problems: []string{fmt.Sprintf("%s is malformed: %v", IMPORT_MAPPING, err)}}
+			}
+		}
+	}
+	return files, mapping, nil
+}
+
+// stage reads every merchant table found in the archive into a temporary table,
+// parents ahead of the tables referencing them. Tables staged before a problem
+// was found are returned alongside it, for the caller to drop.
+func stage(ctx context.Context, conn *sql.Conn, files map[string]string, mapping importMapping) ([]staged, error) {
+	tables, err := merchantTables(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	var res []staged
+	for _, table := range tables {
+		if derived[table.Name] {
+			continue
+		}
+
+		spec := mapping[table.Name]
+		file := spec.File
+		if file == "" {
+			for _, ext := range []string{".csv", ".parquet"} {
+				if candidate := table.Schema + "_" + table.Name + ext; files[candidate] != "" {
+					file = candidate
+					break
+				}
+			}
+			if file == "" {
+				continue
+			}
+		} else if files[file] == "" {
+			problems = append(problems, fmt.Sprintf("%s is mapped to %s which the archive lacks", table.Name, file))
+			continue
+		}
+
+		columns, err := tableColumns(ctx, conn, table)
+		if err != nil {
+			return nil, err
+		}
+
+		source := reader(files[file])
+		available, err := sourceColumns(ctx, conn, source)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s could not be read: %v", file, err))
+			continue
+		}
+
+		var selected []string
+		var present []columnInfo
+		missing := false
+		for _, col := range columns {
+			name := col.name
+			if mapped, ok := spec.Columns[col.name]; ok {
+				name = mapped
+			}
+			if !available[name] {
+				if !col.optional {
+					problems = append(problems, fmt.Sprintf("%s lacks column %s for %s.%s", file, name, table.Name, col.name))
+					missing = true
+				}
+				continue
+			}
+			selected = append(selected, fmt.Sprintf("%s AS %s", ident(name), ident(col.name)))
+			present = append(present, col)
+		}
+		if missing {
+			continue
+		}
+
+		s := staged{table: table, columns: present, file: file}
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(
+			"CREATE OR REPLACE TEMP TABLE %s AS SELECT %s FROM %s;",
+			s.temp(), strings.Join(selected, ", "), source,
+		)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s could not be read: %v", file, err))
+			continue
+		}
+		res = append(res, s)
+	}
+
+	if len(problems) > 0 {
+		return res, &ImportError{Problems: problems}
+	}
+	if len(res) == 0 {
+		return nil, &ImportError{Problems: []string{"the archive holds no merchant tables"}}
+	}
+	return ordered(res), nil
+}
+
+// ordered sorts tables so every table follows the tables it references.
+func ordered(tables []staged) []staged {
+	var res []staged
+	placed := make(map[string]bool)
+	for len(res) < len(tables) {
+		progressed := false
+		for _, table := range tables {
+			if placed[table.table.Name] {
+				continue
+			}
+			ready := true
+			for _, parent := range references[table.table.Name] {
+				if !placed[parent] && parent != table.table.Name && staging(tables, parent) != nil {
+					ready = false
+				}
+			}
+			if ready {
+				res = append(res, table)
+				placed[table.table.Name] = true
+				progressed = true
+			}
+		}
+		// reference cycles are not expected, place what is left as is
+		if !progressed {
+			for _, table := range tables {
+				if !placed[table.table.Name] {
+					res = append(res, table)
+					placed[table.table.Name] = true
+				}
+			}
+		}
+	}
+	return res
+}
+
+func staging(tables []staged, name string) *staged {
+	for i := range tables {
+		if tables[i].table.Name == name {
+			return &tables[i]
+		}
+	}
+	return nil
+}
+
+// validate checks the staged values before anything is written: ids have to be
+// present and unique, values have to cast to their column's type and references
+// have to resolve within the archive.
+func validate(ctx context.Context, conn *sql.Conn, tables []staged) error {
+	var problems []string
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, table := range tables {
+		name := table.table.Name
+
+		samples, err := sample(ctx, conn, fmt.Sprintf(
+			"SELECT CAST(id AS VARCHAR) FROM %s GROUP BY id HAVING id IS NULL OR COUNT(*) > 1", table.temp(),
+		))
+		if err != nil {
+			return err
+		}
+		if len(samples) > 0 {
+			report("%s has missing or duplicate ids: %s", name, strings.Join(samples, ", "))
+		}
+
+		for _, col := range table.columns {
+			if col.name == "id" {
+				continue
+			}
+
+			if parent, ok := references[name][col.name]; ok {
+				target := staging(tables, parent)
+				if target == nil {
+					samples, err = sample(ctx, conn, fmt.Sprintf(
+						"SELECT DISTINCT CAST(%[1]s AS VARCHAR) FROM %[2]s WHERE %[1]s IS NOT NULL", ident(col.name), table.temp(),
+					))
+					if err != nil {
+						return err
+					}
+					if len(samples) > 0 {
+						report("%s.%s references %s which the archive lacks", name, col.name, parent)
+					}
+					continue
+				}
+
+				samples, err = sample(ctx, conn, fmt.Sprintf(`
+                    SELECT DISTINCT CAST(c.%[1]s AS VARCHAR)
+                    FROM %[2]s c
+                    ANTI JOIN %[3]s p ON CAST(p.id AS VARCHAR) = CAST(c.%[1]s AS VARCHAR)
+                      WHERE c.%[1]s IS NOT NULL
+                `, ident(col.name), table.temp(), target.temp()))
+				if err != nil {
+					return err
+				}
+				if len(samples) > 0 {
+					report("%s.%s references %s missing from %s: %s", name, col.name, parent, target.file, strings.Join(samples, ", "))
+				}
+				continue
+			}
+
+			samples, err = sample(ctx, conn, fmt.Sprintf(
+				"SELECT DISTINCT CAST(%[1]s AS VARCHAR) FROM %[2]s WHERE %[1]s IS NOT NULL AND TRY_CAST(%[1]s AS %[3]s) IS NULL",
+				ident(col.name), table.temp(), col.dataType,
+			))
+			if err != nil {
+				return err
+			}
+			if len(samples) > 0 {
+				report("%s.%s has values that are not %s: %s", name, col.name, col.dataType, strings.Join(samples, ", "))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ImportError{Problems: problems}
+	}
+	return nil
+}
+
+// load assigns the staged rows fresh ids and inserts them for the merchant,
+// rewriting references to the ids given to the parent rows.
+func load(ctx context.Context, conn *sql.Conn, table staged, tables []staged, merchantID uuid.UUID) (int64, error) {
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(
+		"CREATE OR REPLACE TEMP TABLE %s AS SELECT DISTINCT CAST(id AS VARCHAR) AS source, gen_random_uuid() AS id FROM %s;",
+		table.keys(), table.temp(),
+	)); err != nil {
+		return 0, fmt.Errorf("failed to assign ids to %s: %w", table.table.Name, err)
+	}
+
+	var names, values, joins []string
+	for i, col := range table.columns {
+		names = append(names, ident(col.name))
+
+		if col.name == "id" {
+			values = append(values, "k.id")
+			continue
+		}
+		if parent, ok := references[table.table.Name][col.name]; ok {
+			alias := fmt.Sprintf("r%d", i)
+			values = append(values, alias+".id")
+			joins = append(joins, fmt.Sprintf(
+				"LEFT JOIN %s %s ON %s.source = CAST(s.%s AS VARCHAR)", staging(tables, parent).keys(), alias, alias, ident(col.name),
+			))
+			continue
+		}
+		values = append(values, fmt.Sprintf("CAST(s.%s AS %s)", ident(col.name), col.dataType))
+	}
+
+	res, err := conn.ExecContext(ctx, fmt.Sprintf(`
+        INSERT INTO %s.%s (%s, merchant_id)
+        SELECT %s, ?
+        FROM %s s
+        JOIN %s k ON k.source = CAST(s.id AS VARCHAR)
+        %s;
+    `,
+		table.table.Schema, table.table.Name, strings.Join(names, ", "),
+		strings.Join(values, ", "),
+		table.temp(), table.keys(), strings.Join(joins, "\n        "),
+	), merchantID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert imported %s: %w", table.table.Name, err)
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count imported %s: %w", table.table.Name, err)
+	}
+	return inserted, nil
+}
+
+func tableColumns(ctx context.Context, db querier, table tableInfo) ([]columnInfo, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT column_name, data_type, column_default IS NOT NULL
+        FROM information_schema.columns
+        WHERE table_schema = $1 AND table_name = $2 AND column_name != 'merchant_id'
+        ORDER BY ordinal_position;
+    `, table.Schema, table.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query columns for table %q: %w", table.Name, err)
+	}
+	defer rows.Close()
+
+	var res []columnInfo
+	for rows.Next() {
+		var col columnInfo
+		if err := rows.Scan(&col.name, &col.dataType, &col.optional); err != nil {
+			return nil, fmt.Errorf("failed to scan column of table %s: %w", table.Name, err)
+		}
+		res = append(res, col)
+	}
+	return res, rows.Err()
+}
+
+func sourceColumns(ctx context.Context, db querier, source string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT column_name FROM (DESCRIBE SELECT * FROM %s);", source))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		res[name] = true
+	}
+	return res, rows.Err()
+}
+
+func sample(ctx context.Context, db querier, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("%s LIMIT %d;", query, MAX_IMPORT_SAMPLES))
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate import: %w", err)
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var value sql.NullString
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("failed to validate import: %w", err)
+		}
+		if !value.Valid {
+			value.String = "NULL"
+		}
+		res = append(res, value.String)
+	}
+	return res, rows.Err()
+}
+
+// reader is the table function reading a file of the archive, CSV values are
+// read as text so that validate gets to see what does not cast.
+func reader(path string) string {
+	path = strings.ReplaceAll(path, "'", "''")
+	if strings.HasSuffix(path, ".parquet") {
+		return fmt.Sprintf("read_parquet('%s')", path)
+	}
+	return fmt.Sprintf("read_csv('%s', header = true, all_varchar = true)", path)
+}
+
+func ident(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+)
+
+// validArchive is the smallest sale an archive can describe, by file name.
+var validArchive = map[string]string{
+	"main_products.csv":          "id,name,price_cents\np1,Tea,350\np2,Cake,500\n",
+	"main_transactions.csv":      "id,created_at\nt1,2026-01-01 10:00:00\n",
+	"main_transaction_lines.csv": "id,transaction_id,product_id,quantity\nl1,t1,p1,2\nl2,t1,p2,1\n",
+}
+
+// withFiles is the valid archive with some of its files replaced or added.
+func withFiles(files map[string]string) map[string]string {
+	res := maps.Clone(validArchive)
+	maps.Copy(res, files)
+	return res
+}
+
+func zipped(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func countMerchants(t *testing.T, g *generator) int {
+	t.Helper()
+
+	var count int
+	if err := sql.OpenDB(g.connector).QueryRowContext(context.Background(), "SELECT COUNT(*) FROM main.merchants;").Scan(&count); err != nil {
+		t.Fatalf("failed to count merchants: %v", err)
+	}
+	return count
+}
+
+func TestImportArchive(t *testing.T) {
+	g := emptyStore(t)
+	lg, reporter := quiet()
+
+	res, err := g.importArchive(context.Background(), lg, reporter, zipped(t, validArchive), "Imported")
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	want := map[string]int64{"products": 2, "transactions": 1, "transaction_lines": 2}
+	if !maps.Equal(res.Rows, want) {
+		t.Errorf("imported %v, want %v", res.Rows, want)
+	}
+	if got := countMerchants(t, g); got != 1 {
+		t.Errorf("%d merchants after import, want 1", got)
+	}
+}
+
+func TestImportArchiveRejectsBadRows(t *testing.T) {
+	cases := []struct {
+		name    string
+		files   map[string]string
+		archive string
+		problem string
+	}{
+		{
+			name:    "not a zip",
+			archive: "id,name,price_cents\n",
+			problem: "not a zip archive",
+		},
+		{
+			name:    "no merchant tables",
+			files:   map[string]string{"notes.csv": "a,b\n1,2\n"},
+			problem: "the archive holds no merchant tables",
+		},
+		{
+			name:    "malformed mapping",
+			files:   withFiles(map[string]string{IMPORT_MAPPING: "{"}),
+			problem: "mapping.json is malformed",
+		},
+		{
+			name:    "mapped file absent",
+			files:   withFiles(map[string]string{IMPORT_MAPPING: `{"products":{"file":"items.csv"}}`}),
+			problem: "products is mapped to items.csv which the archive lacks",
+		},
+		{
+			name:    "missing required column",
+			files:   withFiles(map[string]string{"main_products.csv": "id,name\np1,Tea\np2,Cake\n"}),
+			problem: "main_products.csv lacks column price_cents for products.price_cents",
+		},
+		{
+			name:    "duplicate id",
+			files:   withFiles(map[string]string{"main_products.csv": "id,name,price_cents\np1,Tea,350\np1,Cake,500\n"}),
+			problem: "products has missing or duplicate ids: p1",
+		},
+		{
+			name:    "missing id",
+			files:   withFiles(map[string]string{"main_transactions.csv": "id,created_at\nt1,2026-01-01 10:00:00\n,2026-01-02 10:00:00\n"}),
+			problem: "transactions has missing or duplicate ids",
+		},
+		{
+			name:    "value of the wrong type",
+			files:   withFiles(map[string]string{"main_products.csv": "id,name,price_cents\np1,Tea,350\np2,Cake,lots\n"}),
+			problem: "products.price_cents has values that are not INTEGER: lots",
+		},
+		{
+			name:    "dangling reference",
+			files:   withFiles(map[string]string{"main_transaction_lines.csv": "id,transaction_id,product_id,quantity\nl1,t1,p1,2\nl2,t1,p3,1\n"}),
+			problem: "transaction_lines.product_id references products missing from main_products.csv: p3",
+		},
+		{
+			name: "reference to a table the archive lacks",
+			files: withFiles(map[string]string{
+				"main_transactions.csv": "id,created_at,location_id\nt1,2026-01-01 10:00:00,shop\n",
+			}),
+			problem: "transactions.location_id references locations which the archive lacks",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g := emptyStore(t)
+			lg, reporter := quiet()
+
+			archive := bytes.NewBufferString(c.archive)
+			if c.files != nil {
+				archive = zipped(t, c.files)
+			}
+
+			_, err := g.importArchive(context.Background(), lg, reporter, archive, "Imported")
+			var invalid *ImportError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("import error = %v, want an ImportError", err)
+			}
+			if !errors.Is(err, ErrInvalidImport) {
+				t.Errorf("import error %v does not wrap ErrInvalidImport", err)
+			}
+			if !strings.Contains(invalid.Error(), c.problem) {
+				t.Errorf("import problems %q, want one containing %q", invalid.Problems, c.problem)
+			}
+			if got := countMerchants(t, g); got != 0 {
+				t.Errorf("%d merchants after a rejected import, want 0", got)
+			}
+		})
+	}
+}
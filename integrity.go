@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/suessflorian/client-side-analytics/telemetry"
+)
+
+// The integrity validator can only report violations, or also repair what has
+// an unambiguous fix and quarantine the rest, or quarantine every violating
+// row. Nothing is ever deleted outright, quarantined rows land in
+// main.quarantine.
+const (
+	INTEGRITY_REPORT     = "report"
+	INTEGRITY_REPAIR     = "repair"
+	INTEGRITY_QUARANTINE = "quarantine"
+)
+
+var integrityModes = map[string]bool{INTEGRITY_REPORT: true, INTEGRITY_REPAIR: true, INTEGRITY_QUARANTINE: true}
+
+const (
+	VIOLATION_MISSING_ID         = "missing_id"
+	VIOLATION_DUPLICATE_ID       = "duplicate_id"
+	VIOLATION_UNKNOWN_MERCHANT   = "unknown_merchant"
+	VIOLATION_DANGLING_REFERENCE = "dangling_reference"
+	VIOLATION_MERCHANT_MISMATCH  = "merchant_mismatch"
+)
+
+// INTEGRITY_SAMPLES is how many violating rows are shown per violation unless
+// asked otherwise.
+const INTEGRITY_SAMPLES = 5
+
+// INTEGRITY_PASSES bounds how often fixing violations is repeated, fixing a
+// row can leave those referencing it dangling in turn.
+const INTEGRITY_PASSES = 8
+
+// detachable references are optional, repair detaches rows from a parent that
+// does not exist rather than quarantining them.
+var detachable = map[string]map[string]bool{
+	"categories":      {"parent_id": true},
+	"products":        {"category_id": true},
+	"transactions":    {"original_transaction_id": true, "customer_id": true, "location_id": true},
+	"stock_movements": {"transaction_line_id": true},
+}
+
+// constraint is a relationship the schema leaves undeclared, rows selecting
+// the rowids of the table's rows violating it.
+type constraint struct {
+	kind   string
+	table  tableInfo
+	column string
+	target string
+	rows   string
+	// owner is the merchant owning a violating row t.
+	owner string
+}
+
+type Violation struct {
+	Check      string `json:"check"`
+	Table      string `json:"table"`
+	Column     string `json:"column,omitempty"`
+	References string `json:"references,omitempty"`
+	Rows       int64  `json:"rows"`
+	// Samples are violating rows as DuckDB renders them as text.
+	Samples []string `json:"samples"`
+}
+
+// IntegrityReport lists the violations found, and when fixing them the rows
+// repaired in place and quarantined per table, with whatever violations
+// fixing left behind.
+type IntegrityReport struct {
+	Mode        string           `json:"mode"`
+	Violations  []Violation      `json:"violations"`
+	Repaired    map[string]int64 `json:"repaired,omitempty"`
+	Quarantined map[string]int64 `json:"quarantined,omitempty"`
+	Remaining   []Violation      `json:"remaining,omitempty"`
+}
+
+// Clean tells whether no violation was found or remains.
+func (r IntegrityReport) Clean() bool {
+	if r.Mode == INTEGRITY_REPORT {
+		return len(r.Violations) == 0
+	}
+	return len(r.Remaining) == 0
+}
+
+// checkIntegrity validates the primary and foreign keys the schema comments
+// out, fixing the violations in one transaction unless only reporting them.
+// Derived tables are rebuilt for the merchants whose rows were fixed.
+func (g *generator) checkIntegrity(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, mode string, samples int) (IntegrityReport, error) {
+	if !integrityModes[mode] {
+		return IntegrityReport{}, fmt.Errorf("unknown integrity mode %q", mode)
+	}
+
+	conn, err := sql.OpenDB(g.connector).Conn(ctx)
+	if err != nil {
+		return IntegrityReport{}, fmt.Errorf("could not connect: %w", err)
+	}
+	defer conn.Close()
+
+	constraints, err := constraints(ctx, conn)
+	if err != nil {
+		return IntegrityReport{}, err
+	}
+
+	res := IntegrityReport{Mode: mode}
+	if res.Violations, err = violations(ctx, conn, constraints, samples); err != nil {
+		return IntegrityReport{}, err
+	}
+	if mode == INTEGRITY_REPORT || len(res.Violations) == 0 {
+		return res, nil
+	}
+
+	res.Repaired, res.Quarantined = make(map[string]int64), make(map[string]int64)
+	if err := atomically(ctx, conn, func() error {
+		touched := make(map[uuid.UUID]bool)
+		for pass := 0; pass < INTEGRITY_PASSES; pass++ {
+			var fixed int64
+			for _, c := range constraints {
+				n, err := fix(ctx, conn, c, mode, &res, touched)
+				if err != nil {
+					return err
+				}
+				fixed += n
+			}
+			if fixed == 0 {
+				break
+			}
+		}
+
+		for merchantID := range touched {
+			var exists bool
+			if err := conn.QueryRowContext(ctx, `
+                SELECT EXISTS (SELECT 1 FROM main.merchants WHERE id = ?);
+            `, merchantID).Scan(&exists); err != nil {
+				return fmt.Errorf("failed to look up merchant: %w", err)
+			}
+			if !exists {
+				continue
+			}
+			if err := refreshStock(ctx, conn, merchantID, nil); err != nil {
+				return err
+			}
+			if err := refreshRollups(ctx, conn, merchantID, time.Time{}, nil); err != nil {
+				return err
+			}
+		}
+
+		res.Remaining, err = violations(ctx, conn, constraints, samples)
+		return err
+	}); err != nil {
+		return IntegrityReport{}, err
+	}
+
+	if err := g.recount(ctx, reporter); err != nil {
+		lg.WithError(err).Error("failed to recount entities after integrity fixes")
+	}
+	return res, nil
+}
+
+// constraints lists what is checked, in the order fixes are best applied: the
+// rows themselves, then their merchant, then what they reference.
+func constraints(ctx context.Context, db querier) ([]constraint, error) {
+	tables, err := merchantTables(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]tableInfo{"merchants": {Schema: "main", Name: "merchants"}}
+	for _, table := range tables {
+		present[table.Name] = table
+	}
+
+	var keyed, owned, referenced []constraint
+	for _, table := range append([]tableInfo{present["merchants"]}, tables...) {
+		if derived[table.Name] {
+			continue
+		}
+		owner := "t.merchant_id"
+		if table.Name == "merchants" {
+			owner = "t.id"
+		}
+		name := fmt.Sprintf("%s.%s", ident(table.Schema), ident(table.Name))
+
+		keyed = append(keyed, constraint{
+			kind:  VIOLATION_MISSING_ID,
+			table: table,
+			rows:  fmt.Sprintf("SELECT t.rowid FROM %s t WHERE t.id IS NULL", name),
+			owner: owner,
+		}, constraint{
+			kind:  VIOLATION_DUPLICATE_ID,
+			table: table,
+			rows: fmt.Sprintf(`
+                SELECT rowid FROM (
+                  SELECT t.rowid, ROW_NUMBER() OVER (PARTITION BY t.id ORDER BY t.rowid) AS copy
+                  FROM %s t
+                    WHERE t.id IS NOT NULL
+                ) WHERE copy > 1`, name),
+			owner: owner,
+		})
+	}
+
+	for _, table := range tables {
+		name := fmt.Sprintf("%s.%s", ident(table.Schema), ident(table.Name))
+		owned = append(owned, constraint{
+			kind:  VIOLATION_UNKNOWN_MERCHANT,
+			table: table,
+			rows: fmt.Sprintf(`
+                SELECT t.rowid FROM %s t
+                  WHERE t.merchant_id IS NULL OR NOT EXISTS (SELECT 1 FROM main.merchants m WHERE m.id = t.merchant_id)`, name),
+			owner: "t.merchant_id",
+		})
+
+		columns := make([]string, 0, len(references[table.Name]))
+		for column := range references[table.Name] {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		for _, column := range columns {
+			target, ok := present[references[table.Name][column]]
+			if !ok {
+				continue
+			}
+			parent := fmt.Sprintf("%s.%s", ident(target.Schema), ident(target.Name))
+			referenced = append(referenced, constraint{
+				kind:   VIOLATION_DANGLING_REFERENCE,
+				table:  table,
+				column: column,
+				target: target.Name,
+				rows: fmt.Sprintf(`
+                    SELECT t.rowid FROM %[1]s t
+                      WHERE t.%[2]s IS NOT NULL AND NOT EXISTS (SELECT 1 FROM %[3]s p WHERE p.id = t.%[2]s)`,
+					name, ident(column), parent),
+				owner: "t.merchant_id",
+			}, constraint{
+				kind:   VIOLATION_MERCHANT_MISMATCH,
+				table:  table,
+				column: column,
+				target: target.Name,
+				rows: fmt.Sprintf(`
+                    SELECT t.rowid FROM %[1]s t
+                      WHERE EXISTS (SELECT 1 FROM %[3]s p WHERE p.id = t.%[2]s)
+                        AND NOT EXISTS (SELECT 1 FROM %[3]s p WHERE p.id = t.%[2]s AND p.merchant_id = t.merchant_id)`,
+					name, ident(column), parent),
+				owner: "t.merchant_id",
+			})
+		}
+	}
+
+	return append(append(keyed, owned...), referenced...), nil
+}
+
+// violations runs the constraints, listing those violated with samples of the
+// violating rows.
+func violations(ctx context.Context, db *sql.Conn, constraints []constraint, samples int) ([]Violation, error) {
+	res := []Violation{}
+	for _, c := range constraints {
+		violation := Violation{Check: c.kind, Table: c.table.Name, Column: c.column, References: c.target, Samples: []string{}}
+		if err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM (%s);", c.rows)).Scan(&violation.Rows); err != nil {
+			return nil, fmt.Errorf("failed to check %s of %s: %w", c.kind, c.table.Name, err)
+		}
+		if violation.Rows == 0 {
+			continue
+		}
+
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+            SELECT CAST(t AS VARCHAR)
+            FROM %s.%s t
+              WHERE t.rowid IN (%s)
+            ORDER BY t.rowid
+            LIMIT ?;
+        `, ident(c.table.Schema), ident(c.table.Name), c.rows), samples)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sample %s of %s: %w", c.kind, c.table.Name, err)
+		}
+		for rows.Next() {
+			var row string
+			if err := rows.Scan(&row); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan violating row: %w", err)
+			}
+			violation.Samples = append(violation.Samples, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("row iteration error: %w", err)
+		}
+
+		res = append(res, violation)
+	}
+	return res, nil
+}
+
+// fix repairs or quarantines the rows violating the constraint as the mode has
+// it, noting the merchants whose rows it touched.
+func fix(ctx context.Context, conn *sql.Conn, c constraint, mode string, res *IntegrityReport, touched map[uuid.UUID]bool) (int64, error) {
+	name := fmt.Sprintf("%s.%s", ident(c.table.Schema), ident(c.table.Name))
+
+	owners, err := conn.QueryContext(ctx, fmt.Sprintf(
+		"SELECT DISTINCT %s FROM %s t WHERE t.rowid IN (%s) AND %s IS NOT NULL;", c.owner, name, c.rows, c.owner,
+	))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find owners of %s in %s: %w", c.kind, c.table.Name, err)
+	}
+	for owners.Next() {
+		var merchantID uuid.UUID
+		if err := owners.Scan(&merchantID); err != nil {
+			owners.Close()
+			return 0, fmt.Errorf("failed to scan owner: %w", err)
+		}
+		touched[merchantID] = true
+	}
+	owners.Close()
+	if err := owners.Err(); err != nil {
+		return 0, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	if mode == INTEGRITY_REPAIR && c.kind == VIOLATION_DANGLING_REFERENCE && detachable[c.table.Name][c.column] {
+		detached, err := conn.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET %s = NULL WHERE rowid IN (%s);", name, ident(c.column), c.rows,
+		))
+		if err != nil {
+			return 0, fmt.Errorf("failed to detach %s.%s: %w", c.table.Name, c.column, err)
+		}
+		n, err := detached.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("failed to count rows detached: %w", err)
+		}
+		if n > 0 {
+			res.Repaired[c.table.Name] += n
+		}
+		return n, nil
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`
+        INSERT INTO main.quarantine (source, reason, merchant, row, quarantined_at)
+        SELECT ?, ?, %s, CAST(t AS VARCHAR), now()
+        FROM %s t
+          WHERE t.rowid IN (%s);
+    `, c.owner, name, c.rows), c.table.Name, c.kind); err != nil {
+		return 0, fmt.Errorf("failed to quarantine %s of %s: %w", c.kind, c.table.Name, err)
+	}
+	quarantined, err := conn.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE rowid IN (%s);", name, c.rows,
+	))
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove quarantined %s of %s: %w", c.kind, c.table.Name, err)
+	}
+	n, err := quarantined.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count rows quarantined: %w", err)
+	}
+	if n > 0 {
+		res.Quarantined[c.table.Name] += n
+	}
+	return n, nil
+}
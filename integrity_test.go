@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// fingerprints sums up every merchant table and the merchants themselves by
+// row count and a hash of their rows.
+func fingerprints(t *testing.T, connector *duckdb.Connector) map[string]string {
+	t.Helper()
+
+	ctx := context.Background()
+	db := sql.OpenDB(connector)
+	tables, err := merchantTables(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables = append(tables, tableInfo{Schema: "main", Name: "merchants"})
+
+	res := make(map[string]string)
+	for _, table := range tables {
+		var count int64
+		var hash sql.NullString
+		if err := db.QueryRowContext(ctx, fmt.Sprintf(
+			"SELECT COUNT(*), CAST(bit_xor(hash(CAST(t AS VARCHAR))) AS VARCHAR) FROM %s.%s t;", ident(table.Schema), ident(table.Name),
+		)).Scan(&count, &hash); err != nil {
+			t.Fatalf("failed to fingerprint %s: %v", table.Name, err)
+		}
+		res[table.Name] = fmt.Sprintf("%d rows hashing to %s", count, hash.String)
+	}
+	return res
+}
+
+func TestIntegrityQuarantinesDanglingRow(t *testing.T) {
+	connector, merchantID := seededStore(t, 42, "tiny", "2026-01-01")
+	g := &generator{connector: connector}
+	lg, reporter := quiet()
+	ctx := context.Background()
+
+	before := fingerprints(t, connector)
+
+	dangling := uuid.New()
+	if _, err := sql.OpenDB(connector).ExecContext(ctx, `
+        INSERT INTO main.payments (id, transaction_id, tender, amount_cents, merchant_id)
+        VALUES (?, ?, 'cash', 100, ?);
+    `, dangling, uuid.New(), merchantID); err != nil {
+		t.Fatalf("failed to insert dangling payment: %v", err)
+	}
+
+	res, err := g.checkIntegrity(ctx, lg, reporter, INTEGRITY_QUARANTINE, INTEGRITY_SAMPLES)
+	if err != nil {
+		t.Fatalf("failed to check integrity: %v", err)
+	}
+	if len(res.Violations) != 1 || res.Violations[0].Check != VIOLATION_DANGLING_REFERENCE {
+		t.Errorf("violations = %+v, want the one dangling payment", res.Violations)
+	}
+	if !res.Clean() {
+		t.Errorf("violations remain after quarantine: %+v", res.Remaining)
+	}
+	if want := map[string]int64{"payments": 1}; !maps.Equal(res.Quarantined, want) {
+		t.Errorf("quarantined %v, want %v", res.Quarantined, want)
+	}
+
+	var source, reason string
+	var merchant uuid.UUID
+	if err := sql.OpenDB(connector).QueryRowContext(ctx, `
+        SELECT source, reason, merchant FROM main.quarantine WHERE row LIKE '%' || ? || '%';
+    `, dangling.String()).Scan(&source, &reason, &merchant); err != nil {
+		t.Fatalf("failed to find the quarantined payment: %v", err)
+	}
+	if source != "payments" || reason != VIOLATION_DANGLING_REFERENCE || merchant != merchantID {
+		t.Errorf("quarantined payment from %s for %s of %s, want payments for %s of %s", source, reason, merchant, VIOLATION_DANGLING_REFERENCE, merchantID)
+	}
+
+	after := fingerprints(t, connector)
+	for table, fingerprint := range before {
+		if after[table] != fingerprint {
+			t.Errorf("%s went from %s to %s", table, fingerprint, after[table])
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Inventory reports each product's stock as of the merchant's latest stock
+// movement, with its trade over the Days before.
+type Inventory struct {
+	AsOf     *time.Time     `json:"as_of"`
+	Days     int            `json:"days"`
+	Products []ProductStock `json:"products"`
+}
+
+type ProductStock struct {
+	ProductID   uuid.UUID `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	OnHand      int64     `json:"on_hand"`
+	Received    int64     `json:"received"`
+	Sold        int64     `json:"sold"`
+	// SellThrough is the share of the stock available over the window that got
+	// sold, being what sold and what is left on hand.
+	SellThrough *float64 `json:"sell_through"`
+	// DaysOfCover is how long what is on hand lasts at the window's rate of
+	// sale, nil when nothing sold.
+	DaysOfCover *float64 `json:"days_of_cover"`
+	OutOfStock  bool     `json:"out_of_stock"`
+}
+
+// GetInventory returns the stock of each of the merchant's products, those
+// running out soonest first.
+func (a *analytics) GetInventory(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID, days int) (Inventory, error) {
+	levels, levelArgs := inLocations("location_id", locations)
+	moves, moveArgs := inLocations("location_id", locations)
+	query := fmt.Sprintf(`
+        WITH levels AS (
+          SELECT product_id, SUM(on_hand) AS on_hand, MAX(updated_at) AS updated_at
+          FROM main.stock_levels
+            WHERE merchant_id = ?%s
+          GROUP BY product_id
+        ), as_of AS (
+          SELECT MAX(updated_at) AS at FROM levels
+        ), trade AS (
+          SELECT
+            m.product_id,
+            SUM(m.quantity) FILTER (WHERE m.kind = ?) AS received,
+            -SUM(m.quantity) FILTER (WHERE m.kind = ?) AS sold
+          FROM main.stock_movements m, as_of
+            WHERE m.merchant_id = ? AND m.created_at > as_of.at - to_days(CAST(? AS INTEGER))%s
+          GROUP BY m.product_id
+        )
+        SELECT
+          p.id,
+          p.name,
+          CAST(COALESCE(l.on_hand, 0) AS BIGINT),
+          CAST(COALESCE(t.received, 0) AS BIGINT),
+          CAST(COALESCE(t.sold, 0) AS BIGINT),
+          (SELECT at FROM as_of)
+        FROM main.products p
+        LEFT JOIN levels l ON l.product_id = p.id
+        LEFT JOIN trade t ON t.product_id = p.id
+          WHERE p.merchant_id = ?
+        ORDER BY p.name ASC, p.id ASC;
+    `, and(levels), and(moves))
+	args := append([]any{merchantID}, levelArgs...)
+	args = append(args, STOCK_RECEIPT, STOCK_SALE, merchantID, days)
+	args = append(append(args, moveArgs...), merchantID)
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, args...)
+	if err != nil {
+		return Inventory{}, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	res := Inventory{Days: days, Products: []ProductStock{}}
+	for rows.Next() {
+		var product ProductStock
+		if err := rows.Scan(&product.ProductID, &product.ProductName, &product.OnHand, &product.Received, &product.Sold, &res.AsOf); err != nil {
+			return Inventory{}, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		// stock sold without ever being received leaves nothing on hand
+		remaining := max(product.OnHand, 0)
+		product.OutOfStock = remaining == 0
+		if available := product.Sold + remaining; product.Sold > 0 && available > 0 {
+			sellThrough := float64(product.Sold) / float64(available)
+			product.SellThrough = &sellThrough
+		}
+		if product.Sold > 0 {
+			cover := float64(remaining) / (float64(product.Sold) / float64(days))
+			product.DaysOfCover = &cover
+		}
+		res.Products = append(res.Products, product)
+	}
+
+	if err := rows.Err(); err != nil {
+		return Inventory{}, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	sort.SliceStable(res.Products, func(i, j int) bool {
+		a, b := res.Products[i].DaysOfCover, res.Products[j].DaysOfCover
+		return a != nil && (b == nil || *a < *b)
+	})
+	return res, nil
+}
+
+// GetStockouts narrows the inventory down to the products out of stock or that
+// will be within the given number of days at their current rate of sale.
+func (a *analytics) GetStockouts(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID, days, within int) (Inventory, error) {
+	inventory, err := a.GetInventory(ctx, merchantID, locations, days)
+	if err != nil {
+		return Inventory{}, err
+	}
+
+	running := []ProductStock{}
+	for _, product := range inventory.Products {
+		if product.OutOfStock || (product.DaysOfCover != nil && *product.DaysOfCover < float64(within)) {
+			running = append(running, product)
+		}
+	}
+	inventory.Products = running
+	return inventory, nil
+}
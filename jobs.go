@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/suessflorian/client-side-analytics/telemetry"
+)
+
+const (
+	JOB_RUNNING   = "running"
+	JOB_COMPLETED = "completed"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+// JOB_RETENTION is how long finished jobs remain queryable.
+const JOB_RETENTION = time.Hour
+
+var ErrJobNotFound = errors.New("job not found")
+
+// jobs runs generations in the background, detached from the request that
+// started them.
+type jobs struct {
+	generator *generator
+
+	mu   sync.Mutex
+	byID map[uuid.UUID]*job
+}
+
+func newJobs(generator *generator) *jobs {
+	return &jobs{generator: generator, byID: make(map[uuid.UUID]*job)}
+}
+
+type job struct {
+	id       uuid.UUID
+	seed     int64
+	cancel   context.CancelFunc
+	done     chan struct{}
+	progress *progress
+
+	mu       sync.Mutex
+	state    string
+	finished time.Time
+	result   *generated
+	err      error
+}
+
+type JobStatus struct {
+	ID         uuid.UUID                `json:"id"`
+	Status     string                   `json:"status"`
+	Seed       int64                    `json:"seed"`
+	StartedAt  time.Time                `json:"started_at"`
+	FinishedAt *time.Time               `json:"finished_at,omitempty"`
+	ETASeconds *float64                 `json:"eta_seconds,omitempty"`
+	Tables     map[string]tableProgress `json:"tables"`
+	Merchants  []Merchant               `json:"merchants"`
+	Result     *generated               `json:"result,omitempty"`
+	Error      string                   `json:"error,omitempty"`
+}
+
+func (j *jobs) start(lg *logrus.Logger, reporter *telemetry.Reporter, params generation) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &job{
+		id:       uuid.New(),
+		seed:     params.Seed,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		progress: newProgress(),
+		state:    JOB_RUNNING,
+	}
+
+	j.mu.Lock()
+	j.prune()
+	j.byID[job.id] = job
+	j.mu.Unlock()
+
+	go func() {
+		defer close(job.done)
+		defer cancel()
+
+		generated, err := j.generator.create(ctx, lg, reporter, params, job.progress)
+
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		job.finished = time.Now()
+		switch {
+		case err == nil:
+			job.state, job.result = JOB_COMPLETED, &generated
+		case errors.Is(err, context.Canceled):
+			job.state = JOB_CANCELLED
+		default:
+			job.state, job.err = JOB_FAILED, err
+			lg.WithError(err).WithField("job", job.id).Error("generation job failed")
+		}
+	}()
+
+	return job
+}
+
+func (j *jobs) get(id uuid.UUID) (*job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.byID[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// prune forgets finished jobs past their retention, callers hold the lock.
+func (j *jobs) prune() {
+	for id, job := range j.byID {
+		job.mu.Lock()
+		expired := job.state != JOB_RUNNING && time.Since(job.finished) > JOB_RETENTION
+		job.mu.Unlock()
+		if expired {
+			delete(j.byID, id)
+		}
+	}
+}
+
+// stop cancels the job and waits for it to wind down and clean up.
+func (job *job) stop(ctx context.Context) error {
+	job.cancel()
+	select {
+	case <-job.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (job *job) status() JobStatus {
+	snapshot := job.progress.snapshot()
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	res := JobStatus{
+		ID:        job.id,
+		Status:    job.state,
+		Seed:      job.seed,
+		StartedAt: job.progress.started,
+		Tables:    snapshot.tables,
+		Merchants: snapshot.completed,
+		Result:    job.result,
+	}
+	if job.err != nil {
+		res.Error = job.err.Error()
+	}
+	if job.state == JOB_RUNNING {
+		res.ETASeconds = snapshot.eta
+	} else {
+		res.FinishedAt = &job.finished
+	}
+	return res
+}
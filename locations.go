@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// LOCATION_SPREAD is the standard deviation of the log of a location's traffic
+// level, a merchant's busiest shop typically trading several times what its
+// quietest does.
+const LOCATION_SPREAD = 0.75
+
+var locationNames = []string{
+	"Downtown",
+	"Harbourside",
+	"Northgate",
+	"Riverside",
+	"Westfield",
+	"Airport",
+	"Old Town",
+	"Eastside",
+	"Uptown",
+	"Market Square",
+	"Southbank",
+	"Hillcrest",
+	"Lakeside",
+	"Station",
+	"Parkview",
+	"Bayside",
+	"Midtown",
+	"Westgate",
+	"Seaview",
+	"Central",
+}
+
+// locationWeights draws the location of each transaction by traffic level.
+type locationWeights struct {
+	ids        []uuid.UUID
+	cumulative []float64
+}
+
+func (l locationWeights) sample(rng *rand.Rand) uuid.UUID {
+	return l.ids[pick(rng, l.cumulative)]
+}
+
+// locations writes the merchant's locations, each with a log-normally drawn
+// traffic level. Names are only reused, numbered, once all have been taken.
+func (g *generator) locations(ctx context.Context, conn *sql.Conn, w *worker, rng *rand.Rand, merchantID uuid.UUID, amount int) (locationWeights, error) {
+	var res locationWeights
+	rows := make([]string, amount)
+	args := make([]any, 0, 3*amount)
+	names := rng.Perm(len(locationNames))
+	var total float64
+	for i := 0; i < amount; i++ {
+		id := uuid.Must(uuid.NewRandomFromReader(rng))
+		name := locationNames[names[i%len(names)]]
+		if round := i / len(names); round > 0 {
+			name += " " + strconv.Itoa(round+1)
+		}
+		total += math.Exp(rng.NormFloat64() * LOCATION_SPREAD)
+
+		res.ids = append(res.ids, id)
+		res.cumulative = append(res.cumulative, total)
+		rows[i] = "(?, ?, ?)"
+		args = append(args, id, name, merchantID)
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO main.locations (id, name, merchant_id) VALUES %s;", strings.Join(rows, ", "),
+	), args...); err != nil {
+		return locationWeights{}, fmt.Errorf("failed to insert locations: %w", err)
+	}
+	w.tracker.expect("locations", amount)
+	w.wroteMany("locations", amount)
+	return res, nil
+}
@@ -3,18 +3,39 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/suessflorian/client-side-analytics/middleware"
-	"github.com/suessflorian/client-side-analytics/store/duckdb"
+	store "github.com/suessflorian/client-side-analytics/store/duckdb"
 	"github.com/suessflorian/client-side-analytics/telemetry"
 )
 
+// DATABASE is the DuckDB file every command works against.
+const DATABASE = "duck.db"
+
+const usage = `usage: client-side-analytics <command> [flags]
+
+commands:
+  serve     serve the API and the client, the default without a command
+  generate  generate merchants and print what was generated
+  export    write a merchant's tables to a CSV or Parquet archive
+  verify    check that a merchant's export reproduces the server analytics
+  validate  check referential integrity, optionally repairing violations
+  migrate   list (status) or apply (up) the database migrations
+  stats     print the row counts of every table
+
+run "client-side-analytics <command> -h" for the command's flags
+`
+
 func main() {
 	ctx := context.Background()
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, os.Kill)
@@ -24,34 +45,104 @@ func main() {
 	lg.SetLevel(logrus.InfoLevel)
 	lg.SetFormatter(&logrus.JSONFormatter{})
 
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var code int
+	switch command {
+	case "serve":
+		code = serve(ctx, lg, args)
+	case "generate":
+		code = generateCommand(ctx, lg, args)
+	case "export":
+		code = exportCommand(ctx, lg, args)
+	case "verify":
+		code = verifyCommand(ctx, lg, args)
+	case "validate":
+		code = validateCommand(ctx, lg, args)
+	case "migrate":
+		code = migrateCommand(ctx, lg, args)
+	case "stats":
+		code = statsCommand(ctx, lg, args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		code = 2
+	}
+	os.Exit(code)
+}
+
+func serve(ctx context.Context, lg *logrus.Logger, args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of merchants generated in parallel")
+	_ = flags.Parse(args)
+
+	_, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		lg.WithError(err).Error("invalid -addr")
+		return 2
+	}
+
 	engine, reporter := telemetry.New(ctx, lg)
 
-	connector, err := duckdb.Init(ctx, lg, "duck.db")
+	connector, err := store.Init(ctx, lg, DATABASE)
 	if err != nil {
-		lg.WithError(err).Fatal("database connection failure")
+		lg.WithError(err).Error("database connection failure")
+		return 1
 	}
 	defer connector.Close()
 
-	generator, err := newMerchantGenerator(ctx, lg, reporter, connector)
+	generator, err := newMerchantGenerator(ctx, lg, reporter, connector, max(*workers, 1))
 	if err != nil {
-		lg.WithError(err).Fatal("failed to initialise merchant generator")
+		lg.WithError(err).Error("failed to initialise merchant generator")
+		return 1
 	}
 
 	mux := http.NewServeMux()
-	h := &handler{generator: generator, analytics: &analytics{connector}}
+	h := &handler{generator: generator, jobs: newJobs(generator), simulator: newSimulator(generator), analytics: &analytics{connector}}
 
 	var register = func(pattern string, handler http.HandlerFunc) {
 		mux.HandleFunc(pattern, middleware.WithContextUtils(handler, lg, reporter))
 	}
 
-	register("POST /generate", h.generateHandler) // middleware.WithLimitOneAtATime
+	register("POST /generate", h.generateHandler)
+	register("GET /jobs/{id}", h.jobHandler)
+	register("DELETE /jobs/{id}", h.cancelJobHandler)
+	register("POST /import", h.importHandler)
+	register("GET /merchants", h.merchantsHandler)
+	register("GET /merchants/{merchant_id}", h.merchantHandler)
+	register("DELETE /merchants/{merchant_id}", h.deleteMerchantHandler)
+	register("POST /simulator", h.startSimulatorHandler)
+	register("GET /simulator", h.simulatorHandler)
+	register("DELETE /simulator", h.stopSimulatorHandler)
+
+	register("GET /admin/integrity", h.integrityHandler)
+	register("POST /admin/integrity", h.integrityHandler)
+
 	register("GET /analytics/{merchant_id}", middleware.Delay(h.analyticsHandler))
+	register("GET /analytics/{merchant_id}/forecast", h.forecastHandler)
+	register("GET /analytics/{merchant_id}/pivot", h.pivotHandler)
+	register("GET /analytics/{merchant_id}/categories", h.categoriesHandler)
+	register("GET /analytics/{merchant_id}/locations", h.locationsHandler)
+	register("GET /analytics/{merchant_id}/tenders", h.tendersHandler)
+	register("GET /analytics/{merchant_id}/inventory", h.inventoryHandler)
+	register("GET /analytics/{merchant_id}/stockouts", h.stockoutsHandler)
+	register("GET /analytics/{merchant_id}/retention", h.retentionHandler)
+	register("GET /analytics/{merchant_id}/lifetime-value", h.lifetimeValueHandler)
+	register("GET /analytics/{merchant_id}/new-vs-returning", h.customerSplitHandler)
+	register("POST /analytics/{merchant_id}/query", h.queryHandler)
+	register("GET /semantic", h.catalogueHandler)
+	register("POST /semantic/compile", h.compileHandler)
 	register("GET /loader/{merchant_id}", middleware.WithLimitOneAtATime(h.loaderHandler))
 	register("GET /telemetry", engine.ServeHTTP)
 	register("/", http.FileServer(http.Dir("./static")).ServeHTTP)
 
 	server := http.Server{
-		Addr:    ":8080",
+		Addr:    *addr,
 		Handler: mux,
 	}
 
@@ -64,10 +155,10 @@ func main() {
 				lg.WithError(err).Error("failed to get LAN IP address")
 			}
 		} else {
-			lg.Infof("⚡️ listening on http://%s:8080 ⚡️", address)
+			lg.Infof("⚡️ listening on http://%s:%s ⚡️", address, port)
 		}
 
-		lg.Info("⚡️ listening on http://localhost:8080 ⚡️")
+		lg.Infof("⚡️ listening on http://localhost:%s ⚡️", port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			lg.WithError(err).Info("error starting localhost server")
 		}
@@ -83,6 +174,7 @@ func main() {
 	if err := engine.Close(shutdownCtx); err != nil {
 		lg.WithError(err).Error("failed to gracefully shutdown telemetry engine")
 	}
+	return 0
 }
 
 var ErrNoLANIPAddressFound = errors.New("no local area network ip address found")
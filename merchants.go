@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// merchantSorts are the orders merchants can be listed in, a leading "-"
+// sorting descending. Ties are broken by id so that cursors are stable.
+var merchantSorts = map[string]string{
+	"name":          "name",
+	"-name":         "name",
+	"transactions":  "transactions",
+	"-transactions": "transactions",
+}
+
+type MerchantSummary struct {
+	ID           uuid.UUID `json:"id"`
+	Name         string    `json:"name"`
+	Transactions int64     `json:"transactions"`
+}
+
+// MerchantPage is one page of the merchant listing, Next being the cursor of
+// the page after it, nil on the last page.
+type MerchantPage struct {
+	Merchants []MerchantSummary `json:"merchants"`
+	Next      *string           `json:"next"`
+}
+
+// merchantCursor is where a page left off, encoded opaquely for the client. It
+// remembers the sort it was issued under as it means nothing under another.
+type merchantCursor struct {
+	Sort         string    `json:"sort"`
+	Name         string    `json:"name"`
+	Transactions int64     `json:"transactions"`
+	ID           uuid.UUID `json:"id"`
+}
+
+func (c merchantCursor) encode() (string, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeMerchantCursor(encoded, sort string) (merchantCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return merchantCursor{}, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	var res merchantCursor
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return merchantCursor{}, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	if res.Sort != sort {
+		return merchantCursor{}, fmt.Errorf("%w: issued for sort %q", ErrInvalidCursor, res.Sort)
+	}
+	return res, nil
+}
+
+// ListMerchants pages through the merchants whose name contains search, case
+// insensitively, resuming after the cursor when given one.
+func (a *analytics) ListMerchants(ctx context.Context, search, sort, cursor string, limit int) (MerchantPage, error) {
+	key, ok := merchantSorts[sort]
+	if !ok {
+		return MerchantPage{}, fmt.Errorf("unknown merchant sort %q", sort)
+	}
+	direction, after := "ASC", ">"
+	if strings.HasPrefix(sort, "-") {
+		direction, after = "DESC", "<"
+	}
+
+	resume, args := "", []any{search}
+	if cursor != "" {
+		from, err := decodeMerchantCursor(cursor, sort)
+		if err != nil {
+			return MerchantPage{}, err
+		}
+		var at any = from.Name
+		if key == "transactions" {
+			at = from.Transactions
+		}
+		resume = fmt.Sprintf("WHERE %[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?)", key, after)
+		args = append(args, at, at, from.ID)
+	}
+
+	query := fmt.Sprintf(`
+        WITH listing AS (
+          SELECT m.id, m.name, COALESCE(t.transactions, 0) AS transactions
+          FROM main.merchants m
+          LEFT JOIN (
+            SELECT merchant_id, COUNT(*) AS transactions
+            FROM main.transactions
+            GROUP BY merchant_id
+          ) t ON t.merchant_id = m.id
+            WHERE contains(lower(m.name), lower(?))
+        )
+        SELECT id, name, transactions
+        FROM listing
+        %s
+        ORDER BY %s %s, id %s
+        LIMIT ?;
+    `, resume, key, direction, direction)
+	// one more than asked tells whether there is a next page
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, append(args, limit+1)...)
+	if err != nil {
+		return MerchantPage{}, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	res := MerchantPage{Merchants: []MerchantSummary{}}
+	for rows.Next() {
+		var merchant MerchantSummary
+		if err := rows.Scan(&merchant.ID, &merchant.Name, &merchant.Transactions); err != nil {
+			return MerchantPage{}, fmt.Errorf("failed to scan row: %w", err)
+		}
+		res.Merchants = append(res.Merchants, merchant)
+	}
+
+	if err := rows.Err(); err != nil {
+		return MerchantPage{}, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	if len(res.Merchants) > limit {
+		res.Merchants = res.Merchants[:limit]
+		last := res.Merchants[limit-1]
+		next, err := merchantCursor{Sort: sort, Name: last.Name, Transactions: last.Transactions, ID: last.ID}.encode()
+		if err != nil {
+			return MerchantPage{}, fmt.Errorf("failed to encode cursor: %w", err)
+		}
+		res.Next = &next
+	}
+	return res, nil
+}
+
+// MerchantDetail describes what the server holds of a merchant, for the client
+// to judge whether downloading it is worthwhile.
+type MerchantDetail struct {
+	ID   uuid.UUID        `json:"id"`
+	Name string           `json:"name"`
+	Rows map[string]int64 `json:"rows"`
+	// From and To bound the merchant's transactions, nil when there are none.
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+	// ExportBytes approximates the size of the export's CSV files before they
+	// are compressed.
+	ExportBytes int64 `json:"export_bytes"`
+}
+
+// GetMerchant returns the merchant's row counts per table, derived ones
+// included, its date range and roughly how large its export comes to.
+func (a *analytics) GetMerchant(ctx context.Context, merchantID uuid.UUID) (MerchantDetail, error) {
+	db := sql.OpenDB(a.connector)
+
+	res := MerchantDetail{ID: merchantID, Rows: make(map[string]int64)}
+	err := db.QueryRowContext(ctx, `
+        SELECT name FROM main.merchants WHERE id = ?;
+    `, merchantID).Scan(&res.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return MerchantDetail{}, fmt.Errorf("%w: %s", ErrUnknownMerchant, merchantID)
+	} else if err != nil {
+		return MerchantDetail{}, fmt.Errorf("failed to look up merchant: %w", err)
+	}
+
+	if err := db.QueryRowContext(ctx, `
+        SELECT MIN(created_at), MAX(created_at) FROM main.transactions WHERE merchant_id = ?;
+    `, merchantID).Scan(&res.From, &res.To); err != nil {
+		return MerchantDetail{}, fmt.Errorf("failed to get date range: %w", err)
+	}
+
+	tables, err := merchantTables(ctx, db)
+	if err != nil {
+		return MerchantDetail{}, err
+	}
+	for _, table := range tables {
+		columns, err := tableColumns(ctx, db, table)
+		if err != nil {
+			return MerchantDetail{}, err
+		}
+
+		// a CSV row is its values separated by commas and ended by a newline,
+		// give or take how the export formats them
+		width := "0"
+		if !derived[table.Name] && len(columns) > 0 {
+			values := make([]string, len(columns))
+			var header int
+			for i, col := range columns {
+				values[i] = fmt.Sprintf("COALESCE(strlen(CAST(%s AS VARCHAR)), 0)", ident(col.name))
+				header += len(col.name) + 1
+			}
+			width = fmt.Sprintf("%d + COALESCE(SUM(%s + %d), 0)", header, strings.Join(values, " + "), len(columns))
+		}
+
+		var count, size int64
+		query := fmt.Sprintf(
+			"SELECT COUNT(*), CAST(%s AS BIGINT) FROM %s.%s WHERE merchant_id = ?;",
+			width, ident(table.Schema), ident(table.Name),
+		)
+		if err := db.QueryRowContext(ctx, query, merchantID).Scan(&count, &size); err != nil {
+			return MerchantDetail{}, fmt.Errorf("failed to size %s: %w", table.Name, err)
+		}
+		res.Rows[table.Name] = count
+		res.ExportBytes += size
+	}
+	return res, nil
+}
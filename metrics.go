@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/suessflorian/client-side-analytics/semantic"
+)
+
+// metrics is the semantic model of the merchant schema, the single definition
+// behind both server side and browser side analytics.
+var metrics = semantic.MustModel(
+	[]semantic.Entity{
+		{Name: "merchant", Table: "merchants", Alias: "m", Scope: "id", ServerOnly: true},
+		{Name: "product", Table: "products", Alias: "p", Scope: "merchant_id"},
+		{Name: "transaction", Table: "transactions", Alias: "t", Scope: "merchant_id"},
+		{Name: "line", Table: "transaction_lines", Alias: "tl", Scope: "merchant_id"},
+		{Name: "customer", Table: "customers", Alias: "c", Scope: "merchant_id"},
+		{Name: "subcategory", Table: "categories", Alias: "sc", Scope: "merchant_id"},
+		{Name: "category", Table: "categories", Alias: "cat", Scope: "merchant_id"},
+		{Name: "location", Table: "locations", Alias: "l", Scope: "merchant_id"},
+		{Name: "payment", Table: "payments", Alias: "pay", Scope: "merchant_id"},
+	},
+	[]semantic.Join{
+		{Child: "line", Parent: "transaction", On: "tl.transaction_id = t.id"},
+		{Child: "line", Parent: "product", On: "tl.product_id = p.id"},
+		{Child: "transaction", Parent: "merchant", On: "t.merchant_id = m.id"},
+		{Child: "transaction", Parent: "customer", On: "t.customer_id = c.id"},
+		{Child: "transaction", Parent: "location", On: "t.location_id = l.id"},
+		{Child: "payment", Parent: "transaction", On: "pay.transaction_id = t.id"},
+		{Child: "product", Parent: "merchant", On: "p.merchant_id = m.id"},
+		{Child: "product", Parent: "subcategory", On: "p.category_id = sc.id"},
+		{Child: "subcategory", Parent: "category", On: "sc.parent_id = cat.id"},
+	},
+	[]semantic.Dimension{
+		{Name: "merchant.name", Entity: "merchant", Expr: "m.name", Description: "Merchant trading name"},
+		{Name: "product.id", Entity: "product", Expr: "p.id", Description: "Product identifier"},
+		{Name: "product.name", Entity: "product", Expr: "p.name", Description: "Product name"},
+		{Name: "product.price_cents", Entity: "product", Expr: "p.price_cents", Description: "Listed product price in cents"},
+		{Name: "category.name", Entity: "category", Expr: "cat.name", Description: "Top level product category"},
+		{Name: "subcategory.name", Entity: "subcategory", Expr: "sc.name", Description: "Product subcategory within its category"},
+		{Name: "transaction.day", Entity: "transaction", Expr: "CAST(t.created_at AS DATE)", Description: "Calendar day of the transaction"},
+		{Name: "transaction.month", Entity: "transaction", Expr: "strftime(t.created_at, '%Y-%m')", Description: "Calendar month of the transaction"},
+		{Name: "transaction.weekday", Entity: "transaction", Expr: "isodow(t.created_at)", Description: "ISO weekday of the transaction, 1 being Monday"},
+		{Name: "transaction.hour", Entity: "transaction", Expr: "hour(t.created_at)", Description: "Hour of day of the transaction"},
+		{Name: "transaction.kind", Entity: "transaction", Expr: "t.kind", Description: "Whether the transaction is a sale, a void or a refund"},
+		{Name: "customer.cohort", Entity: "customer", Expr: "strftime(c.created_at, '%Y-%m')", Description: "Month the customer was first seen, anonymous transactions excluded"},
+		{Name: "location.id", Entity: "location", Expr: "l.id", Description: "Location identifier, transactions made nowhere in particular excluded"},
+		{Name: "location.name", Entity: "location", Expr: "l.name", Description: "Name of the location the transaction was made at"},
+		{Name: "payment.tender", Entity: "payment", Expr: "pay.tender", Description: "Tender a payment was made in, being cash, card or wallet, or unknown for transactions recorded without payments"},
+		{Name: "line.quantity", Entity: "line", Expr: "tl.quantity", Description: "Units on a transaction line"},
+	},
+	[]semantic.Metric{
+		{
+			Name: "revenue", Entities: []string{"line", "product"},
+			Expr:        "CAST(SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) AS DOUBLE)",
+			Description: "Net revenue after discounts, voids and refunds, tax excluded, in cents",
+		},
+		{
+			Name: "gross_revenue", Entities: []string{"line", "product", "transaction"},
+			Expr:        "CAST(COALESCE(SUM(CAST(p.price_cents AS BIGINT) * tl.quantity) FILTER (WHERE t.kind = 'sale'), 0) AS DOUBLE)",
+			Description: "Sum of price times quantity over sales before discounts, in cents",
+		},
+		{
+			Name: "discounts", Entities: []string{"line", "transaction"},
+			Expr:        "CAST(COALESCE(SUM(tl.discount_cents + tl.order_discount_cents) FILTER (WHERE t.kind = 'sale'), 0) AS DOUBLE)",
+			Description: "Line and order discounts granted on sales, in cents",
+		},
+		{
+			Name: "returns", Entities: []string{"line", "product", "transaction"},
+			Expr:        "CAST(COALESCE(-SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) FILTER (WHERE t.kind != 'sale'), 0) AS DOUBLE)",
+			Description: "Revenue given back through voids and refunds, in cents",
+		},
+		{
+			Name: "tax", Entities: []string{"line"},
+			Expr:        "CAST(SUM(tl.tax_cents) AS DOUBLE)",
+			Description: "Tax charged net of voids and refunds, in cents",
+		},
+		{
+			Name: "units", Entities: []string{"line"},
+			Expr:        "CAST(SUM(tl.quantity) AS BIGINT)",
+			Description: "Units sold net of units returned",
+		},
+		{
+			Name: "transactions", Entities: []string{"transaction"},
+			Expr:        "CAST(COUNT(DISTINCT t.id) FILTER (WHERE t.kind = 'sale') AS BIGINT)",
+			Description: "Distinct sales, voids and refunds excluded",
+		},
+		{
+			Name: "customers", Entities: []string{"transaction"},
+			Expr:        "CAST(COUNT(DISTINCT t.customer_id) FILTER (WHERE t.kind = 'sale') AS BIGINT)",
+			Description: "Distinct customers making sales, anonymous ones excluded",
+		},
+		{
+			Name: "paid", Entities: []string{"payment"},
+			Expr:        "CAST(SUM(pay.amount_cents) AS DOUBLE)",
+			Description: "Amount paid net of what voids and refunds paid back, tax included, in cents",
+		},
+		{
+			Name: "products", Entities: []string{"product"},
+			Expr:        "CAST(COUNT(DISTINCT p.id) AS BIGINT)",
+			Description: "Distinct products",
+		},
+		{
+			Name: "average_price", Entities: []string{"line", "product"},
+			Expr:        "CAST(SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) AS DOUBLE) / NULLIF(SUM(tl.quantity), 0)",
+			Description: "Net revenue per unit sold, in cents",
+		},
+		{
+			Name: "average_basket", Entities: []string{"line", "product", "transaction"},
+			Expr:        "CAST(SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) AS DOUBLE) / NULLIF(COUNT(DISTINCT t.id) FILTER (WHERE t.kind = 'sale'), 0)",
+			Description: "Net revenue per sale, in cents",
+		},
+	},
+)
+
+type QueryResult struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+func (a *analytics) Query(ctx context.Context, merchantID uuid.UUID, q semantic.Query) (QueryResult, error) {
+	compiled, err := metrics.Compile(q, semantic.Server, merchantID)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, compiled.SQL, compiled.Args...)
+	if err != nil {
+		return QueryResult{}, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	res := QueryResult{Columns: compiled.Columns, Rows: [][]any{}}
+	for rows.Next() {
+		values := make([]any, len(compiled.Columns))
+		pointers := make([]any, len(compiled.Columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return QueryResult{}, fmt.Errorf("failed to scan row: %w", err)
+		}
+		for i := range values {
+			values[i] = scalar(values[i])
+		}
+		res.Rows = append(res.Rows, values)
+	}
+
+	if err := rows.Err(); err != nil {
+		return QueryResult{}, fmt.Errorf("row iteration error: %w", err)
+	}
+	return res, nil
+}
+
+// registered are the named analytics queries clients run, each of which must
+// give the same answer on the server and against a merchant export.
+var registered = []struct {
+	Name  string
+	Query semantic.Query
+}{
+	{
+		Name: "top_products",
+		Query: semantic.Query{
+			Metrics:    []string{"revenue"},
+			Dimensions: []string{"product.id", "product.name"},
+			Order:      []semantic.Order{{Field: "revenue", Direction: "desc"}, {Field: "product.name"}, {Field: "product.id"}},
+			Limit:      5,
+		},
+	},
+	{
+		Name: "daily_sales",
+		Query: semantic.Query{
+			Metrics:    []string{"revenue", "units", "transactions"},
+			Dimensions: []string{"transaction.day"},
+			Order:      []semantic.Order{{Field: "transaction.day"}},
+		},
+	},
+	{
+		Name: "weekly_traffic",
+		Query: semantic.Query{
+			Metrics:    []string{"transactions"},
+			Dimensions: []string{"transaction.weekday", "transaction.hour"},
+			Order:      []semantic.Order{{Field: "transaction.weekday"}, {Field: "transaction.hour"}},
+		},
+	},
+	{
+		Name: "basket",
+		Query: semantic.Query{
+			Metrics: []string{"average_basket", "average_price", "products"},
+		},
+	},
+	{
+		Name: "revenue_breakdown",
+		Query: semantic.Query{
+			Metrics:    []string{"gross_revenue", "discounts", "returns", "revenue", "tax"},
+			Dimensions: []string{"transaction.month"},
+			Order:      []semantic.Order{{Field: "transaction.month"}},
+		},
+	},
+	{
+		Name: "category_revenue",
+		Query: semantic.Query{
+			Metrics:    []string{"revenue", "units"},
+			Dimensions: []string{"category.name", "subcategory.name"},
+			Order:      []semantic.Order{{Field: "category.name"}, {Field: "subcategory.name"}},
+		},
+	},
+	{
+		Name: "tender_mix",
+		Query: semantic.Query{
+			Metrics:    []string{"paid"},
+			Dimensions: []string{"transaction.month", "payment.tender"},
+			Order:      []semantic.Order{{Field: "transaction.month"}, {Field: "payment.tender"}},
+		},
+	},
+	{
+		Name: "location_sales",
+		Query: semantic.Query{
+			Metrics:    []string{"revenue", "units", "transactions"},
+			Dimensions: []string{"location.name"},
+			Order:      []semantic.Order{{Field: "revenue", Direction: "desc"}, {Field: "location.name"}},
+		},
+	},
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+)
+
+const (
+	TENDER_CASH   = "cash"
+	TENDER_CARD   = "card"
+	TENDER_WALLET = "wallet"
+)
+
+// TENDER_UNKNOWN settles transactions recorded without payments, those
+// predating payments or imported without them.
+const TENDER_UNKNOWN = "unknown"
+
+// tenders are listed in the order profiles weigh them.
+var tenders = []string{TENDER_CASH, TENDER_CARD, TENDER_WALLET}
+
+// SPLIT_SHARE_MIN is the least share of a split sale either tender pays.
+const SPLIT_SHARE_MIN = 0.1
+
+// payment settles some of a transaction's total in one tender. Amounts are
+// signed like the transaction's lines, voids and refunds paying back.
+type payment struct {
+	tender string
+	amount int64
+}
+
+// total is what the lines come to, discounts taken off and tax added.
+func total(lines []line) int64 {
+	var res int64
+	for _, l := range lines {
+		res += l.amount - l.discount - l.orderDiscount + l.tax
+	}
+	return res
+}
+
+// settleUnpaid pays each of the merchant's transactions that has no payments in
+// full in TENDER_UNKNOWN, so tender mix accounts for every transaction. A
+// payment's id is derived from its transaction so settling stays reproducible.
+func settleUnpaid(ctx context.Context, db execer, merchantID uuid.UUID) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+        INSERT INTO main.payments (id, transaction_id, tender, amount_cents, merchant_id)
+        SELECT
+          CAST(md5(CAST(t.id AS VARCHAR)) AS UUID),
+          t.id,
+          ?,
+          COALESCE(SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents + tl.tax_cents), 0),
+          t.merchant_id
+        FROM main.transactions t
+        LEFT JOIN main.transaction_lines tl ON tl.transaction_id = t.id
+        LEFT JOIN main.products p ON p.id = tl.product_id
+          WHERE t.merchant_id = ? AND t.id NOT IN (
+            SELECT transaction_id FROM main.payments WHERE merchant_id = ?
+          )
+        GROUP BY t.id, t.merchant_id;
+    `, TENDER_UNKNOWN, merchantID, merchantID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to settle unpaid transactions: %w", err)
+	}
+	settled, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count settled transactions: %w", err)
+	}
+	return settled, nil
+}
+
+// tender settles amount in one of the profile's tenders, or at SplitRate over
+// two different ones.
+func tender(rng *rand.Rand, p profile, amount int64) []payment {
+	first := pickTender(rng, p, -1)
+	if rng.Float64() >= p.SplitRate {
+		return []payment{{tender: tenders[first], amount: amount}}
+	}
+	second := pickTender(rng, p, first)
+	if second < 0 {
+		return []payment{{tender: tenders[first], amount: amount}}
+	}
+
+	part := cents(float64(amount) * (SPLIT_SHARE_MIN + rng.Float64()*(1-2*SPLIT_SHARE_MIN)))
+	return []payment{
+		{tender: tenders[first], amount: part},
+		{tender: tenders[second], amount: amount - part},
+	}
+}
+
+// pickTender draws a tender by the profile's weights leaving out the excluded
+// one, -1 when no other tender carries any weight.
+func pickTender(rng *rand.Rand, p profile, excluded int) int {
+	cumulative := make([]float64, len(tenders))
+	var sum float64
+	for i, weight := range p.Tenders {
+		if i != excluded {
+			sum += weight
+		}
+		cumulative[i] = sum
+	}
+	if sum == 0 {
+		return -1
+	}
+	return pick(rng, cumulative)
+}
+
+// tenderExpr is the SQL counterpart of pickTender, drawing by the uniform draw
+// and leaving out the tender named by excluded unless it is empty. It is NULL
+// when no other tender carries any weight.
+func tenderExpr(p profile, draw, excluded string) string {
+	if excluded != "" {
+		cases := make([]string, len(tenders))
+		for i, name := range tenders {
+			cases[i] = fmt.Sprintf("WHEN '%s' THEN %s", name, tenderCase(p, draw, i))
+		}
+		return fmt.Sprintf("CASE %s %s END", excluded, strings.Join(cases, " "))
+	}
+	return tenderCase(p, draw, -1)
+}
+
+func tenderCase(p profile, draw string, excluded int) string {
+	var weighted []int
+	var sum float64
+	for i, weight := range p.Tenders {
+		if i != excluded && weight > 0 {
+			weighted = append(weighted, i)
+			sum += weight
+		}
+	}
+	switch len(weighted) {
+	case 0:
+		return "NULL"
+	case 1:
+		return fmt.Sprintf("'%s'", tenders[weighted[0]])
+	}
+
+	var whens []string
+	var cumulative float64
+	for _, i := range weighted[:len(weighted)-1] {
+		cumulative += p.Tenders[i]
+		whens = append(whens, fmt.Sprintf("WHEN %s < %s THEN '%s'", draw, strconv.FormatFloat(cumulative/sum, 'g', -1, 64), tenders[i]))
+	}
+	return fmt.Sprintf("CASE %s ELSE '%s' END", strings.Join(whens, " "), tenders[weighted[len(weighted)-1]])
+}
+
+func appendPayment(appender *duckdb.Appender, id, transactionID, merchantID uuid.UUID, p payment) error {
+	if err := appender.AppendRow(
+		duckdb.UUID(id),
+		duckdb.UUID(transactionID),
+		p.tender,
+		p.amount,
+		duckdb.UUID(merchantID),
+	); err != nil {
+		return fmt.Errorf("failed to append payment row: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidPivot = errors.New("invalid pivot request")
+
+// dimension is a whitelisted grouping key. The expression is grouped on, while
+// columns are what ends up in the result, keyed by their alias. Expressions only
+// reference the fact relation f (and the joined product p, its subcategory sc
+// and category c, and the location l) so they hold for both the raw lines and
+// the daily rollups.
+type dimension struct {
+	expr    string
+	columns []column
+	// hourly dimensions cannot be answered from daily rollups.
+	hourly bool
+}
+
+type column struct {
+	alias string
+	expr  string
+}
+
+type measure struct {
+	raw    string
+	rollup string
+	// additive measures can be summed across products, a transaction holding
+	// several products is counted once per product in the rollups.
+	additive bool
+}
+
+var pivotDimensions = map[string]dimension{
+	"product": {
+		expr: "p.id",
+		columns: []column{
+			{alias: "product_id", expr: "p.id"},
+			{alias: "product_name", expr: "CASE WHEN GROUPING(p.id) = 0 THEN any_value(p.name) END"},
+		},
+	},
+	"category": {
+		expr: "c.id",
+		columns: []column{
+			{alias: "category_id", expr: "c.id"},
+			{alias: "category_name", expr: "CASE WHEN GROUPING(c.id) = 0 THEN any_value(c.name) END"},
+		},
+	},
+	"subcategory": {
+		expr: "sc.id",
+		columns: []column{
+			{alias: "subcategory_id", expr: "sc.id"},
+			{alias: "subcategory_name", expr: "CASE WHEN GROUPING(sc.id) = 0 THEN any_value(sc.name) END"},
+		},
+	},
+	"location": {
+		expr: "f.location_id",
+		columns: []column{
+			{alias: "location_id", expr: "f.location_id"},
+			{alias: "location_name", expr: "CASE WHEN GROUPING(f.location_id) = 0 THEN any_value(l.name) END"},
+		},
+	},
+	"hour": {
+		expr:    "hour(f.ts)",
+		columns: []column{{alias: "hour", expr: "hour(f.ts)"}},
+		hourly:  true,
+	},
+	"weekday": {
+		expr:    "isodow(f.ts)",
+		columns: []column{{alias: "weekday", expr: "isodow(f.ts)"}},
+	},
+	"month": {
+		expr:    "strftime(f.ts, '%Y-%m')",
+		columns: []column{{alias: "month", expr: "strftime(f.ts, '%Y-%m')"}},
+	},
+}
+
+var pivotMeasures = map[string]measure{
+	"revenue": {
+		raw:      "CAST(SUM(f.revenue) AS DOUBLE)",
+		rollup:   "CAST(SUM(f.revenue) AS DOUBLE)",
+		additive: true,
+	},
+	"gross_revenue": {
+		raw:      "CAST(SUM(f.gross_revenue) AS DOUBLE)",
+		rollup:   "CAST(SUM(f.gross_revenue) AS DOUBLE)",
+		additive: true,
+	},
+	"discounts": {
+		raw:      "CAST(SUM(f.discounts) AS DOUBLE)",
+		rollup:   "CAST(SUM(f.discounts) AS DOUBLE)",
+		additive: true,
+	},
+	"returns": {
+		raw:      "CAST(SUM(f.returns) AS DOUBLE)",
+		rollup:   "CAST(SUM(f.returns) AS DOUBLE)",
+		additive: true,
+	},
+	"tax": {
+		raw:      "CAST(SUM(f.tax) AS DOUBLE)",
+		rollup:   "CAST(SUM(f.tax) AS DOUBLE)",
+		additive: true,
+	},
+	"units": {
+		raw:      "CAST(SUM(f.units) AS BIGINT)",
+		rollup:   "CAST(SUM(f.units) AS BIGINT)",
+		additive: true,
+	},
+	"transactions": {
+		raw:    "CAST(COUNT(DISTINCT f.transaction_id) AS BIGINT)",
+		rollup: "CAST(SUM(f.transactions) AS BIGINT)",
+	},
+	"average_price": {
+		raw:      "CAST(SUM(f.revenue) AS DOUBLE) / NULLIF(SUM(f.units), 0)",
+		rollup:   "CAST(SUM(f.revenue) AS DOUBLE) / NULLIF(SUM(f.units), 0)",
+		additive: true,
+	},
+}
+
+// The raw facts mirror the rollups line by line: revenue is net of discounts
+// and reversals, gross revenue and discounts only cover sales and only sales
+// count as transactions.
+const (
+	rawFacts = `(
+          SELECT tl.merchant_id, tl.product_id, t.location_id, t.created_at AS ts,
+            CASE WHEN t.kind = 'sale' THEN t.id END AS transaction_id,
+            CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents AS revenue,
+            CASE WHEN t.kind = 'sale' THEN CAST(p.price_cents AS BIGINT) * tl.quantity ELSE 0 END AS gross_revenue,
+            CASE WHEN t.kind = 'sale' THEN tl.discount_cents + tl.order_discount_cents ELSE 0 END AS discounts,
+            CASE WHEN t.kind != 'sale' THEN -(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) ELSE 0 END AS returns,
+            tl.tax_cents AS tax,
+            tl.quantity AS units
+          FROM main.transaction_lines tl
+          JOIN main.transactions t ON t.id = tl.transaction_id
+          JOIN main.products p ON p.id = tl.product_id
+        )`
+	rollupFacts = `(
+          SELECT merchant_id, product_id, location_id, CAST(day AS TIMESTAMP) AS ts, revenue, gross_revenue, discounts, returns, tax, units, transactions
+          FROM main.daily_product_rollups
+        )`
+)
+
+const (
+	SUBTOTALS_NONE   = "none"
+	SUBTOTALS_ROLLUP = "rollup"
+	SUBTOTALS_CUBE   = "cube"
+)
+
+type pivotRequest struct {
+	Dimensions []string
+	Measures   []string
+	Subtotals  string
+	From       time.Time
+	To         time.Time
+	Products   []uuid.UUID
+	// Categories drills down into categories or subcategories.
+	Categories []uuid.UUID
+	Locations  []uuid.UUID
+}
+
+type PivotResult struct {
+	Dimensions []string    `json:"dimensions"`
+	Measures   []string    `json:"measures"`
+	Rows       []PivotCell `json:"rows"`
+}
+
+type PivotCell struct {
+	// Subtotal marks rows aggregated over at least one of the requested
+	// dimensions, those dimensions being reported as null.
+	Subtotal   bool           `json:"subtotal"`
+	Dimensions map[string]any `json:"dimensions"`
+	Measures   map[string]any `json:"measures"`
+}
+
+// rollable reports whether the daily rollups hold enough detail to answer the
+// request, date filters being day aligned already.
+func (req pivotRequest) rollable() bool {
+	product := false
+	for _, name := range req.Dimensions {
+		if pivotDimensions[name].hourly {
+			return false
+		}
+		product = product || name == "product"
+	}
+	for _, name := range req.Measures {
+		if !pivotMeasures[name].additive && (!product || (req.Subtotals != "" && req.Subtotals != SUBTOTALS_NONE)) {
+			return false
+		}
+	}
+	return true
+}
+
+// compile builds the pivot query strictly out of whitelisted fragments, the only
+// caller provided values reaching the database are the bound arguments.
+func (req pivotRequest) compile(merchantID uuid.UUID) (string, []any, error) {
+	if len(req.Measures) == 0 {
+		return "", nil, fmt.Errorf("%w: at least one measure is required", ErrInvalidPivot)
+	}
+	rollup := req.rollable()
+
+	var selects, groups []string
+	seen := make(map[string]bool)
+	for _, name := range req.Dimensions {
+		dim, ok := pivotDimensions[name]
+		if !ok {
+			return "", nil, fmt.Errorf("%w: unknown dimension %q", ErrInvalidPivot, name)
+		}
+		if seen[name] {
+			return "", nil, fmt.Errorf("%w: duplicate dimension %q", ErrInvalidPivot, name)
+		}
+		seen[name] = true
+
+		for _, col := range dim.columns {
+			selects = append(selects, fmt.Sprintf("%s AS %s", col.expr, col.alias))
+		}
+		groups = append(groups, dim.expr)
+	}
+
+	for _, name := range req.Measures {
+		m, ok := pivotMeasures[name]
+		if !ok {
+			return "", nil, fmt.Errorf("%w: unknown measure %q", ErrInvalidPivot, name)
+		}
+		if seen[name] {
+			return "", nil, fmt.Errorf("%w: duplicate measure %q", ErrInvalidPivot, name)
+		}
+		seen[name] = true
+
+		expr := m.raw
+		if rollup {
+			expr = m.rollup
+		}
+		selects = append(selects, fmt.Sprintf("%s AS %s", expr, name))
+	}
+
+	if len(groups) > 0 {
+		selects = append(selects, fmt.Sprintf("GROUPING(%s) AS subtotal", strings.Join(groups, ", ")))
+	} else {
+		selects = append(selects, "0 AS subtotal")
+	}
+
+	where := []string{"f.merchant_id = ?"}
+	args := []any{merchantID}
+	if !req.From.IsZero() {
+		where = append(where, "f.ts >= ?")
+		args = append(args, req.From)
+	}
+	if !req.To.IsZero() {
+		where = append(where, "f.ts < ?")
+		args = append(args, req.To)
+	}
+	if len(req.Products) > 0 {
+		placeholders := make([]string, len(req.Products))
+		for i, product := range req.Products {
+			placeholders[i] = "?"
+			args = append(args, product)
+		}
+		where = append(where, fmt.Sprintf("f.product_id IN (%s)", strings.Join(placeholders, ", ")))
+	}
+	if clause, locations := inLocations("f.location_id", req.Locations); clause != "" {
+		where = append(where, clause)
+		args = append(args, locations...)
+	}
+	if len(req.Categories) > 0 {
+		placeholders := make([]string, len(req.Categories))
+		for i, category := range req.Categories {
+			placeholders[i] = "?"
+			args = append(args, category)
+		}
+		for _, category := range req.Categories {
+			args = append(args, category)
+		}
+		where = append(where, fmt.Sprintf("(c.id IN (%[1]s) OR sc.id IN (%[1]s))", strings.Join(placeholders, ", ")))
+	}
+
+	facts := rawFacts
+	if rollup {
+		facts = rollupFacts
+	}
+
+	query := fmt.Sprintf(`
+        SELECT %s
+        FROM %s f
+        JOIN main.products p ON p.id = f.product_id
+        LEFT JOIN main.categories sc ON sc.id = p.category_id
+        LEFT JOIN main.categories c ON c.id = sc.parent_id
+        LEFT JOIN main.locations l ON l.id = f.location_id
+          WHERE %s
+    `, strings.Join(selects, ", "), facts, strings.Join(where, " AND "))
+
+	if len(groups) > 0 {
+		switch req.Subtotals {
+		case "", SUBTOTALS_NONE:
+			query += fmt.Sprintf("GROUP BY %s", strings.Join(groups, ", "))
+		case SUBTOTALS_ROLLUP:
+			query += fmt.Sprintf("GROUP BY ROLLUP (%s)", strings.Join(groups, ", "))
+		case SUBTOTALS_CUBE:
+			query += fmt.Sprintf("GROUP BY CUBE (%s)", strings.Join(groups, ", "))
+		default:
+			return "", nil, fmt.Errorf("%w: unknown subtotals mode %q", ErrInvalidPivot, req.Subtotals)
+		}
+
+		order := make([]string, len(groups))
+		for i, group := range groups {
+			order[i] = group + " ASC NULLS LAST"
+		}
+		query += fmt.Sprintf("\nORDER BY %s", strings.Join(order, ", "))
+	}
+
+	return query, args, nil
+}
+
+func (a *analytics) Pivot(ctx context.Context, merchantID uuid.UUID, req pivotRequest) (PivotResult, error) {
+	query, args, err := req.compile(merchantID)
+	if err != nil {
+		return PivotResult{}, err
+	}
+
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, args...)
+	if err != nil {
+		return PivotResult{}, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return PivotResult{}, fmt.Errorf("failed to get result columns: %w", err)
+	}
+
+	res := PivotResult{Dimensions: req.Dimensions, Measures: req.Measures, Rows: []PivotCell{}}
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return PivotResult{}, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		cell := PivotCell{Dimensions: make(map[string]any), Measures: make(map[string]any)}
+		for i, name := range columns {
+			switch {
+			case name == "subtotal":
+				cell.Subtotal = fmt.Sprint(values[i]) != "0"
+			case pivotMeasures[name].raw != "":
+				cell.Measures[name] = values[i]
+			default:
+				cell.Dimensions[name] = scalar(values[i])
+			}
+		}
+		res.Rows = append(res.Rows, cell)
+	}
+
+	if err := rows.Err(); err != nil {
+		return PivotResult{}, fmt.Errorf("row iteration error: %w", err)
+	}
+	return res, nil
+}
+
+// scalar makes driver values JSON friendly, duckdb hands UUIDs back as raw bytes.
+func scalar(val any) any {
+	if v, ok := val.([]byte); ok && len(v) == 16 {
+		if u, err := uuid.FromBytes(v); err == nil {
+			return u
+		}
+	}
+	return val
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TRANSACTION_SALE   = "sale"
+	TRANSACTION_VOID   = "void"
+	TRANSACTION_REFUND = "refund"
+)
+
+// VOID_WINDOW bounds how long after a sale it may be voided, REFUND_WINDOW how
+// long after it may be refunded.
+const (
+	VOID_WINDOW   = 10 * time.Minute
+	REFUND_WINDOW = 14 * 24 * time.Hour
+)
+
+type product struct {
+	id    uuid.UUID
+	price int
+}
+
+// line is a priced transaction line. Amounts are in cents and signed like the
+// quantity, amount being the undiscounted price times quantity.
+type line struct {
+	id            uuid.UUID
+	product       uuid.UUID
+	quantity      int
+	amount        int64
+	discount      int64
+	orderDiscount int64
+	tax           int64
+}
+
+// basket prices the lines of a sale. Lines may be discounted individually and
+// the order as a whole on top of that, the order discount being allocated over
+// the lines pro rata. Tax is charged on whatever is left.
+func basket(rng *rand.Rand, p profile, lines []line) {
+	order := 0.0
+	if rng.Float64() < p.OrderDiscountRate {
+		order = float64(p.DiscountPercent.pick(rng)) / 100
+	}
+
+	for i := range lines {
+		l := &lines[i]
+		if rng.Float64() < p.DiscountRate {
+			l.discount = cents(float64(l.amount) * float64(p.DiscountPercent.pick(rng)) / 100)
+		}
+		l.orderDiscount = cents(float64(l.amount-l.discount) * order)
+		l.tax = cents(float64(l.amount-l.discount-l.orderDiscount) * p.TaxRate)
+	}
+}
+
+// reverse undoes quantity units of the line, its amounts being reversed pro
+// rata so that reversing every unit nets the line out exactly.
+func (l line) reverse(id uuid.UUID, quantity int) line {
+	share := float64(quantity) / float64(l.quantity)
+	return line{
+		id:            id,
+		product:       l.product,
+		quantity:      -quantity,
+		amount:        -cents(float64(l.amount) * share),
+		discount:      -cents(float64(l.discount) * share),
+		orderDiscount: -cents(float64(l.orderDiscount) * share),
+		tax:           -cents(float64(l.tax) * share),
+	}
+}
+
+func cents(amount float64) int64 {
+	return int64(math.Round(amount))
+}
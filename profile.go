@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+var ErrInvalidProfile = errors.New("invalid generation profile")
+
+// Range is an inclusive span of integers picked uniformly.
+type Range struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (r Range) pick(rng *rand.Rand) int {
+	return r.Min + rng.Intn(r.Max-r.Min+1)
+}
+
+// profile shapes the generated merchants. Counts are per merchant unless said
+// otherwise.
+type profile struct {
+	Merchants           Range `json:"merchants"`
+	Locations           Range `json:"locations"`
+	Products            Range `json:"products"`
+	Transactions        Range `json:"transactions"`
+	LinesPerTransaction Range `json:"lines_per_transaction"`
+	PriceCents          Range `json:"price_cents"`
+	Quantity            Range `json:"quantity"`
+	// QuantitySkew is the chance of each further unit on a line.
+	QuantitySkew float64 `json:"quantity_skew"`
+
+	// Days is the length of the window before the generation anchor that
+	// transactions fall in.
+	Days int `json:"days"`
+	// Growth is the yearly growth rate of traffic over the window.
+	Growth      float64 `json:"growth"`
+	OpeningHour int     `json:"opening_hour"`
+	ClosingHour int     `json:"closing_hour"`
+	// Weekdays weighs traffic per weekday, from Monday to Sunday.
+	Weekdays [7]float64 `json:"weekdays"`
+	// Popularity is the Zipf exponent of product sales, higher concentrating
+	// sales on fewer products.
+	Popularity float64 `json:"popularity"`
+
+	// DiscountRate is the chance of a line being discounted, OrderDiscountRate
+	// that of a whole order, either by a DiscountPercent off.
+	DiscountRate      float64 `json:"discount_rate"`
+	OrderDiscountRate float64 `json:"order_discount_rate"`
+	DiscountPercent   Range   `json:"discount_percent"`
+	// TaxRate is charged on what is left after discounts.
+	TaxRate float64 `json:"tax_rate"`
+	// VoidRate and RefundRate are the chances of a sale being voided right away
+	// or having one of its lines refunded within REFUND_WINDOW.
+	VoidRate   float64 `json:"void_rate"`
+	RefundRate float64 `json:"refund_rate"`
+
+	// IdentifiedRate is the chance of a sale being made by a known customer,
+	// RepeatRate that of a known customer being one seen before. Returning
+	// customers come back ReturnDays after they were won on average.
+	IdentifiedRate float64 `json:"identified_rate"`
+	RepeatRate     float64 `json:"repeat_rate"`
+	ReturnDays     float64 `json:"return_days"`
+
+	// CoverDays is how many days of forecast demand stock gets topped up to,
+	// FillRate the chance of suppliers delivering an order in full and
+	// ShrinkRate the average share of the stock on hand lost each week.
+	CoverDays  float64 `json:"cover_days"`
+	FillRate   float64 `json:"fill_rate"`
+	ShrinkRate float64 `json:"shrink_rate"`
+
+	// Tenders weighs how sales are paid, by cash, card and wallet. SplitRate
+	// is the chance of a sale being split over two tenders.
+	Tenders   [3]float64 `json:"tenders"`
+	SplitRate float64    `json:"split_rate"`
+}
+
+var retailWeek = [7]float64{0.8, 0.85, 0.9, 1, 1.25, 1.5, 1.1}
+
+const DEFAULT_PRESET = "typical"
+
+var presets = map[string]profile{
+	"tiny": {
+		Merchants:           Range{Min: 1, Max: 1},
+		Locations:           Range{Min: 1, Max: 1},
+		Products:            Range{Min: 5, Max: 20},
+		Transactions:        Range{Min: 100, Max: 1_000},
+		LinesPerTransaction: Range{Min: 1, Max: 3},
+		PriceCents:          Range{Min: 100, Max: 5_000},
+		Quantity:            Range{Min: 1, Max: 3},
+		QuantitySkew:        0.2,
+		Days:                90,
+		Growth:              0,
+		OpeningHour:         9,
+		ClosingHour:         17,
+		Weekdays:            retailWeek,
+		Popularity:          1.5,
+		DiscountRate:        0.05,
+		OrderDiscountRate:   0.02,
+		DiscountPercent:     Range{Min: 5, Max: 25},
+		TaxRate:             0.15,
+		VoidRate:            0.01,
+		RefundRate:          0.02,
+		IdentifiedRate:      0.4,
+		RepeatRate:          0.5,
+		ReturnDays:          30,
+		CoverDays:           14,
+		FillRate:            0.9,
+		ShrinkRate:          0.01,
+		Tenders:             [3]float64{0.3, 0.6, 0.1},
+		SplitRate:           0.02,
+	},
+	"typical": {
+		Merchants:           Range{Min: 1, Max: 9},
+		Locations:           Range{Min: 1, Max: 5},
+		Products:            Range{Min: 10, Max: 99},
+		Transactions:        Range{Min: 1_000, Max: 99_999},
+		LinesPerTransaction: Range{Min: 1, Max: 13},
+		PriceCents:          Range{Min: 100, Max: 10_099},
+		Quantity:            Range{Min: 1, Max: 12},
+		QuantitySkew:        0.35,
+		Days:                365,
+		Growth:              0.15,
+		OpeningHour:         8,
+		ClosingHour:         20,
+		Weekdays:            retailWeek,
+		Popularity:          1.2,
+		DiscountRate:        0.08,
+		OrderDiscountRate:   0.03,
+		DiscountPercent:     Range{Min: 5, Max: 30},
+		TaxRate:             0.15,
+		VoidRate:            0.01,
+		RefundRate:          0.03,
+		IdentifiedRate:      0.6,
+		RepeatRate:          0.6,
+		ReturnDays:          21,
+		CoverDays:           21,
+		FillRate:            0.85,
+		ShrinkRate:          0.005,
+		Tenders:             [3]float64{0.2, 0.6, 0.2},
+		SplitRate:           0.03,
+	},
+	"whale": {
+		Merchants:           Range{Min: 1, Max: 1},
+		Locations:           Range{Min: 5, Max: 30},
+		Products:            Range{Min: 500, Max: 2_000},
+		Transactions:        Range{Min: 500_000, Max: 1_000_000},
+		LinesPerTransaction: Range{Min: 1, Max: 13},
+		PriceCents:          Range{Min: 100, Max: 50_000},
+		Quantity:            Range{Min: 1, Max: 12},
+		QuantitySkew:        0.35,
+		Days:                730,
+		Growth:              0.3,
+		OpeningHour:         7,
+		ClosingHour:         22,
+		Weekdays:            retailWeek,
+		Popularity:          1.1,
+		DiscountRate:        0.1,
+		OrderDiscountRate:   0.05,
+		DiscountPercent:     Range{Min: 5, Max: 50},
+		TaxRate:             0.15,
+		VoidRate:            0.005,
+		RefundRate:          0.04,
+		IdentifiedRate:      0.7,
+		RepeatRate:          0.75,
+		ReturnDays:          14,
+		CoverDays:           10,
+		FillRate:            0.8,
+		ShrinkRate:          0.003,
+		Tenders:             [3]float64{0.1, 0.6, 0.3},
+		SplitRate:           0.05,
+	},
+}
+
+// resolveProfile starts from the named preset and applies any overrides on top,
+// fields left out of the overrides keep the preset's value.
+func resolveProfile(preset string, overrides json.RawMessage) (profile, error) {
+	if preset == "" {
+		preset = DEFAULT_PRESET
+	}
+	p, ok := presets[preset]
+	if !ok {
+		return profile{}, fmt.Errorf("%w: unknown preset %q", ErrInvalidProfile, preset)
+	}
+
+	if len(overrides) > 0 {
+		if err := json.Unmarshal(overrides, &p); err != nil {
+			return profile{}, fmt.Errorf("%w: %v", ErrInvalidProfile, err)
+		}
+	}
+	return p, p.validate()
+}
+
+func (p profile) validate() error {
+	for _, bound := range []struct {
+		name     string
+		r        Range
+		min, max int
+	}{
+		{"merchants", p.Merchants, 1, 100},
+		{"locations", p.Locations, 1, 1_000},
+		{"products", p.Products, 1, 100_000},
+		{"transactions", p.Transactions, 0, 10_000_000},
+		{"lines_per_transaction", p.LinesPerTransaction, 1, 100},
+		{"price_cents", p.PriceCents, 1, 10_000_000},
+		{"quantity", p.Quantity, 1, 1_000},
+		{"discount_percent", p.DiscountPercent, 1, 100},
+	} {
+		if bound.r.Min > bound.r.Max {
+			return fmt.Errorf("%w: %s min %d exceeds max %d", ErrInvalidProfile, bound.name, bound.r.Min, bound.r.Max)
+		}
+		if bound.r.Min < bound.min || bound.r.Max > bound.max {
+			return fmt.Errorf("%w: %s must lie within [%d, %d]", ErrInvalidProfile, bound.name, bound.min, bound.max)
+		}
+	}
+
+	switch {
+	case p.Days < 1 || p.Days > 3_650:
+		return fmt.Errorf("%w: days must lie within [1, 3650]", ErrInvalidProfile)
+	case p.Growth <= -1 || p.Growth > 10:
+		return fmt.Errorf("%w: growth must lie within (-1, 10]", ErrInvalidProfile)
+	case p.OpeningHour < 0 || p.ClosingHour > 24 || p.OpeningHour >= p.ClosingHour:
+		return fmt.Errorf("%w: opening hours must satisfy 0 <= opening_hour < closing_hour <= 24", ErrInvalidProfile)
+	case p.Popularity <= 1 || p.Popularity > 5:
+		return fmt.Errorf("%w: popularity must lie within (1, 5]", ErrInvalidProfile)
+	case p.QuantitySkew < 0 || p.QuantitySkew >= 1:
+		return fmt.Errorf("%w: quantity_skew must lie within [0, 1)", ErrInvalidProfile)
+	case p.DiscountRate < 0 || p.DiscountRate > 1 || p.OrderDiscountRate < 0 || p.OrderDiscountRate > 1:
+		return fmt.Errorf("%w: discount rates must lie within [0, 1]", ErrInvalidProfile)
+	case p.TaxRate < 0 || p.TaxRate > 1:
+		return fmt.Errorf("%w: tax_rate must lie within [0, 1]", ErrInvalidProfile)
+	case p.VoidRate < 0 || p.RefundRate < 0 || p.VoidRate+p.RefundRate > 1:
+		return fmt.Errorf("%w: void_rate and refund_rate cannot be negative nor exceed 1 together", ErrInvalidProfile)
+	case p.IdentifiedRate < 0 || p.IdentifiedRate > 1 || p.RepeatRate < 0 || p.RepeatRate > 1:
+		return fmt.Errorf("%w: identified_rate and repeat_rate must lie within [0, 1]", ErrInvalidProfile)
+	case p.ReturnDays <= 0 || p.ReturnDays > 3_650:
+		return fmt.Errorf("%w: return_days must lie within (0, 3650]", ErrInvalidProfile)
+	case p.CoverDays <= 0 || p.CoverDays > 365:
+		return fmt.Errorf("%w: cover_days must lie within (0, 365]", ErrInvalidProfile)
+	case p.FillRate < 0 || p.FillRate > 1 || p.ShrinkRate < 0 || p.ShrinkRate > 1:
+		return fmt.Errorf("%w: fill_rate and shrink_rate must lie within [0, 1]", ErrInvalidProfile)
+	case p.SplitRate < 0 || p.SplitRate > 1:
+		return fmt.Errorf("%w: split_rate must lie within [0, 1]", ErrInvalidProfile)
+	}
+
+	var tendered float64
+	for _, weight := range p.Tenders {
+		if weight < 0 {
+			return fmt.Errorf("%w: tender weights cannot be negative", ErrInvalidProfile)
+		}
+		tendered += weight
+	}
+	if tendered == 0 {
+		return fmt.Errorf("%w: at least one tender needs weight", ErrInvalidProfile)
+	}
+
+	var week float64
+	for _, weight := range p.Weekdays {
+		if weight < 0 {
+			return fmt.Errorf("%w: weekday weights cannot be negative", ErrInvalidProfile)
+		}
+		week += weight
+	}
+	if week == 0 {
+		return fmt.Errorf("%w: at least one weekday needs traffic", ErrInvalidProfile)
+	}
+	return nil
+}
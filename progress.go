@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// progress follows a generation table by table. Expectations start out as
+// profile averages and are corrected as each merchant's actual sizes are drawn.
+type progress struct {
+	started time.Time
+
+	mu        sync.Mutex
+	tables    map[string]tableProgress
+	estimates map[string]int
+	completed []Merchant
+}
+
+type tableProgress struct {
+	Written  int `json:"written"`
+	Expected int `json:"expected"`
+}
+
+func newProgress() *progress {
+	return &progress{
+		started:   time.Now(),
+		tables:    make(map[string]tableProgress),
+		estimates: make(map[string]int),
+		completed: []Merchant{},
+	}
+}
+
+// The tracking methods are no-ops on a nil progress, for generations that
+// nobody follows.
+
+func (p *progress) plan(merchants []Merchant, profile profile) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mean := func(r Range) int { return (r.Min + r.Max) / 2 }
+	p.estimates = map[string]int{
+		"products":          mean(profile.Products),
+		"transactions":      mean(profile.Transactions),
+		"transaction_lines": mean(profile.Transactions) * mean(profile.LinesPerTransaction),
+		"customers":         int(float64(mean(profile.Transactions)) * profile.IdentifiedRate * (1 - profile.RepeatRate)),
+	}
+
+	p.tables["merchants"] = tableProgress{Written: p.tables["merchants"].Written, Expected: len(merchants)}
+	for table, estimate := range p.estimates {
+		p.tables[table] = tableProgress{Expected: estimate * len(merchants)}
+	}
+}
+
+// expect swaps one merchant's estimate for the table with its actual size.
+func (p *progress) expect(table string, amount int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t := p.tables[table]
+	t.Expected += amount - p.estimates[table]
+	p.tables[table] = t
+}
+
+func (p *progress) wrote(table string, amount int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t := p.tables[table]
+	t.Written += amount
+	p.tables[table] = t
+}
+
+func (p *progress) complete(merchant Merchant) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.completed = append(p.completed, merchant)
+}
+
+type progressSnapshot struct {
+	tables    map[string]tableProgress
+	completed []Merchant
+	// eta extrapolates the overall row throughput so far, nil until there is
+	// any to go by.
+	eta *float64
+}
+
+func (p *progress) snapshot() progressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res := progressSnapshot{
+		tables:    make(map[string]tableProgress, len(p.tables)),
+		completed: append([]Merchant{}, p.completed...),
+	}
+
+	var written, expected int
+	for table, t := range p.tables {
+		res.tables[table] = t
+		written += t.Written
+		expected += max(t.Expected, t.Written)
+	}
+
+	if elapsed := time.Since(p.started).Seconds(); written > 0 && elapsed > 0 {
+		eta := float64(expected-written) / (float64(written) / elapsed)
+		res.eta = &eta
+	}
+	return res
+}
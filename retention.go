@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Customers fall in the cohort of the month of their first sale. Revenue is net
+// like everywhere else, a customer's voids and refunds counting against them.
+
+type RetentionCohort struct {
+	Cohort    time.Time `json:"cohort"`
+	Customers int       `json:"customers"`
+	// Periods follow the cohort month by month up to the merchant's latest
+	// month, the first being the cohort month itself.
+	Periods []RetentionPeriod `json:"periods"`
+}
+
+type RetentionPeriod struct {
+	// Offset counts the months since the cohort month.
+	Offset    int     `json:"offset"`
+	Customers int     `json:"customers"`
+	Rate      float64 `json:"rate"`
+}
+
+// GetRetentionCohorts returns how many of each monthly cohort's customers came
+// back to buy in the months after they were won.
+func (a *analytics) GetRetentionCohorts(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID) ([]RetentionCohort, error) {
+	filter, args := inLocations("location_id", locations)
+	query := fmt.Sprintf(`
+        WITH visits AS (
+          SELECT customer_id, date_trunc('month', created_at) AS month
+          FROM main.transactions
+            WHERE merchant_id = ? AND kind = 'sale' AND customer_id IS NOT NULL%s
+          GROUP BY customer_id, month
+        ), cohorts AS (
+          SELECT customer_id, MIN(month) AS cohort
+          FROM visits
+          GROUP BY customer_id
+        )
+        SELECT
+          CAST(c.cohort AS TIMESTAMP) AS cohort,
+          datediff('month', c.cohort, v.month) AS period,
+          COUNT(*) AS customers
+        FROM visits v
+        JOIN cohorts c ON c.customer_id = v.customer_id
+        GROUP BY cohort, period
+        ORDER BY cohort ASC, period ASC;
+    `, and(filter))
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, append([]any{merchantID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	res := []RetentionCohort{}
+	var latest time.Time
+	for rows.Next() {
+		var cohort time.Time
+		var period RetentionPeriod
+		if err := rows.Scan(&cohort, &period.Offset, &period.Customers); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if month := cohort.AddDate(0, period.Offset, 0); month.After(latest) {
+			latest = month
+		}
+
+		if len(res) == 0 || !res[len(res)-1].Cohort.Equal(cohort) {
+			res = append(res, RetentionCohort{Cohort: cohort, Customers: period.Customers})
+		}
+		c := &res[len(res)-1]
+		for len(c.Periods) < period.Offset {
+			c.Periods = append(c.Periods, RetentionPeriod{Offset: len(c.Periods)})
+		}
+		period.Rate = float64(period.Customers) / float64(c.Customers)
+		c.Periods = append(c.Periods, period)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	// months nobody came back in are reported as such up to the latest month
+	for i := range res {
+		c := &res[i]
+		for !c.Cohort.AddDate(0, len(c.Periods), 0).After(latest) {
+			c.Periods = append(c.Periods, RetentionPeriod{Offset: len(c.Periods)})
+		}
+	}
+	return res, nil
+}
+
+type LifetimeValue struct {
+	Customers int     `json:"customers"`
+	Revenue   float64 `json:"revenue"`
+	// AverageValue is the revenue per customer to date, AverageOrders the
+	// sales per customer and RepeatRate the share of customers with more
+	// than one sale.
+	AverageValue  float64       `json:"average_value"`
+	AverageOrders float64       `json:"average_orders"`
+	RepeatRate    float64       `json:"repeat_rate"`
+	Cohorts       []CohortValue `json:"cohorts"`
+}
+
+type CohortValue struct {
+	Cohort        time.Time `json:"cohort"`
+	Customers     int       `json:"customers"`
+	Revenue       float64   `json:"revenue"`
+	AverageValue  float64   `json:"average_value"`
+	AverageOrders float64   `json:"average_orders"`
+	RepeatRate    float64   `json:"repeat_rate"`
+}
+
+// GetLifetimeValue returns what the merchant's customers have been worth so
+// far, overall and per monthly cohort. Older cohorts have naturally had longer
+// to accrue value.
+func (a *analytics) GetLifetimeValue(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID) (LifetimeValue, error) {
+	filter, args := inLocations("t.location_id", locations)
+	query := fmt.Sprintf(`
+        WITH spend AS (
+          SELECT
+            t.customer_id,
+            MIN(t.created_at) FILTER (WHERE t.kind = 'sale') AS first_sale,
+            COUNT(DISTINCT t.id) FILTER (WHERE t.kind = 'sale') AS orders,
+            SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) AS revenue
+          FROM main.transactions t
+          JOIN main.transaction_lines tl ON tl.transaction_id = t.id
+          JOIN main.products p ON p.id = tl.product_id
+            WHERE t.merchant_id = ? AND t.customer_id IS NOT NULL%s
+          GROUP BY t.customer_id
+        )
+        SELECT
+          CAST(date_trunc('month', first_sale) AS TIMESTAMP) AS cohort,
+          COUNT(*) AS customers,
+          CAST(SUM(revenue) AS DOUBLE) AS revenue,
+          SUM(orders) AS orders,
+          COUNT(*) FILTER (WHERE orders > 1) AS repeating
+        FROM spend
+          WHERE first_sale IS NOT NULL
+        GROUP BY cohort
+        ORDER BY cohort ASC;
+    `, and(filter))
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, append([]any{merchantID}, args...)...)
+	if err != nil {
+		return LifetimeValue{}, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	res := LifetimeValue{Cohorts: []CohortValue{}}
+	var orders, repeating int
+	for rows.Next() {
+		var cohort CohortValue
+		var cohortOrders, cohortRepeating int
+		if err := rows.Scan(&cohort.Cohort, &cohort.Customers, &cohort.Revenue, &cohortOrders, &cohortRepeating); err != nil {
+			return LifetimeValue{}, fmt.Errorf("failed to scan row: %w", err)
+		}
+		cohort.AverageValue = cohort.Revenue / float64(cohort.Customers)
+		cohort.AverageOrders = float64(cohortOrders) / float64(cohort.Customers)
+		cohort.RepeatRate = float64(cohortRepeating) / float64(cohort.Customers)
+		res.Cohorts = append(res.Cohorts, cohort)
+
+		res.Customers += cohort.Customers
+		res.Revenue += cohort.Revenue
+		orders += cohortOrders
+		repeating += cohortRepeating
+	}
+
+	if err := rows.Err(); err != nil {
+		return LifetimeValue{}, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	if res.Customers > 0 {
+		res.AverageValue = res.Revenue / float64(res.Customers)
+		res.AverageOrders = float64(orders) / float64(res.Customers)
+		res.RepeatRate = float64(repeating) / float64(res.Customers)
+	}
+	return res, nil
+}
+
+// CustomerSplit breaks a month's revenue down by who it came from. A sale is
+// new business when it is the customer's first, voids and refunds following
+// the sale they undo.
+type CustomerSplit struct {
+	Month              time.Time `json:"month"`
+	NewRevenue         float64   `json:"new_revenue"`
+	ReturningRevenue   float64   `json:"returning_revenue"`
+	AnonymousRevenue   float64   `json:"anonymous_revenue"`
+	NewCustomers       int       `json:"new_customers"`
+	ReturningCustomers int       `json:"returning_customers"`
+}
+
+// GetCustomerSplit returns the monthly revenue of new versus returning
+// customers, anonymous sales being reported apart. Narrowed to some locations,
+// a customer is still only new on their first sale with the merchant.
+func (a *analytics) GetCustomerSplit(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID) ([]CustomerSplit, error) {
+	filter, args := inLocations("t.location_id", locations)
+	query := fmt.Sprintf(`
+        WITH firsts AS (
+          SELECT arg_min(id, created_at) AS sale_id
+          FROM main.transactions
+            WHERE merchant_id = ? AND kind = 'sale' AND customer_id IS NOT NULL
+          GROUP BY customer_id
+        )
+        SELECT
+          CAST(date_trunc('month', t.created_at) AS TIMESTAMP) AS month,
+          CASE
+            WHEN t.customer_id IS NULL THEN 'anonymous'
+            WHEN f.sale_id IS NOT NULL THEN 'new'
+            ELSE 'returning'
+          END AS segment,
+          COUNT(DISTINCT t.customer_id) FILTER (WHERE t.kind = 'sale') AS customers,
+          CAST(SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) AS DOUBLE) AS revenue
+        FROM main.transactions t
+        JOIN main.transaction_lines tl ON tl.transaction_id = t.id
+        JOIN main.products p ON p.id = tl.product_id
+        LEFT JOIN firsts f ON f.sale_id = COALESCE(t.original_transaction_id, t.id)
+          WHERE t.merchant_id = ?%s
+        GROUP BY month, segment
+        ORDER BY month ASC;
+    `, and(filter))
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, append([]any{merchantID, merchantID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	res := []CustomerSplit{}
+	for rows.Next() {
+		var month time.Time
+		var segment string
+		var customers int
+		var revenue float64
+		if err := rows.Scan(&month, &segment, &customers, &revenue); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if len(res) == 0 || !res[len(res)-1].Month.Equal(month) {
+			res = append(res, CustomerSplit{Month: month})
+		}
+		split := &res[len(res)-1]
+		switch segment {
+		case "new":
+			split.NewRevenue, split.NewCustomers = revenue, customers
+		case "returning":
+			split.ReturningRevenue, split.ReturningCustomers = revenue, customers
+		default:
+			split.AnonymousRevenue = revenue
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+	return res, nil
+}
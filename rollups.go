@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// derived tables are maintained from the raw merchant tables, they are never
+// exported since the client can always rebuild them.
+var derived = map[string]bool{
+	"daily_product_rollups": true,
+	"stock_levels":          true,
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// refreshRollups recomputes the merchant's daily product rollups, kept per
+// location, from the given day onwards, a zero since rebuilds every day the
+// merchant has data for. Only the given products are recomputed, all of them
+// when there are none. Revenue is net of discounts, voids and refunds, which
+// are booked on the day they happen, while gross revenue only covers sales.
+func refreshRollups(ctx context.Context, db execer, merchantID uuid.UUID, since time.Time, products []uuid.UUID) error {
+	filter, args := inProducts("product_id", products)
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`
+        DELETE FROM main.daily_product_rollups
+          WHERE merchant_id = ? AND day >= CAST(? AS DATE)%s;
+    `, and(filter)), append([]any{merchantID, since}, args...)...); err != nil {
+		return fmt.Errorf("failed to clear daily product rollups: %w", err)
+	}
+
+	filter, args = inProducts("tl.product_id", products)
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`
+        INSERT INTO main.daily_product_rollups
+          (merchant_id, product_id, location_id, day, revenue, gross_revenue, discounts, returns, tax, units, transactions)
+        SELECT
+          tl.merchant_id,
+          tl.product_id,
+          t.location_id,
+          CAST(t.created_at AS DATE) AS day,
+          SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) AS revenue,
+          COALESCE(SUM(CAST(p.price_cents AS BIGINT) * tl.quantity) FILTER (WHERE t.kind = 'sale'), 0) AS gross_revenue,
+          COALESCE(SUM(tl.discount_cents + tl.order_discount_cents) FILTER (WHERE t.kind = 'sale'), 0) AS discounts,
+          COALESCE(-SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents) FILTER (WHERE t.kind != 'sale'), 0) AS returns,
+          SUM(tl.tax_cents) AS tax,
+          SUM(tl.quantity) AS units,
+          COUNT(DISTINCT t.id) FILTER (WHERE t.kind = 'sale') AS transactions
+        FROM main.transaction_lines tl
+        JOIN main.transactions t ON t.id = tl.transaction_id
+        JOIN main.products p ON p.id = tl.product_id
+          WHERE tl.merchant_id = ? AND CAST(t.created_at AS DATE) >= CAST(? AS DATE)%s
+        GROUP BY tl.merchant_id, tl.product_id, t.location_id, day;
+    `, and(filter)), append([]any{merchantID, since}, args...)...); err != nil {
+		return fmt.Errorf("failed to rebuild daily product rollups: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package semantic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidQuery = errors.New("invalid semantic query")
+
+// Target decides how entity tables are named and whether rows need scoping to
+// a merchant. The server holds every merchant in main.<table>, while the browser
+// loads a single merchant's export as main_<table> without merchant_id columns.
+type Target struct {
+	Name   string
+	Table  func(table string) string
+	Scoped bool
+}
+
+var (
+	Server = Target{
+		Name:   "server",
+		Table:  func(table string) string { return "main." + table },
+		Scoped: true,
+	}
+	Browser = Target{
+		Name:   "browser",
+		Table:  func(table string) string { return "main_" + table },
+		Scoped: false,
+	}
+)
+
+func TargetByName(name string) (Target, error) {
+	switch name {
+	case "", Server.Name:
+		return Server, nil
+	case Browser.Name:
+		return Browser, nil
+	}
+	return Target{}, fmt.Errorf("%w: unknown target %q", ErrInvalidQuery, name)
+}
+
+type Query struct {
+	Metrics    []string `json:"metrics"`
+	Dimensions []string `json:"dimensions"`
+	Filters    []Filter `json:"filters"`
+	Order      []Order  `json:"order"`
+	Limit      int      `json:"limit"`
+}
+
+// Filter restricts a dimension, or a metric in which case it applies after
+// aggregation. Value is used by every operator but "in", which takes Values.
+type Filter struct {
+	Field    string `json:"field"`
+	Operator string `json:"operator"`
+	Value    any    `json:"value"`
+	Values   []any  `json:"values"`
+}
+
+type Order struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"`
+}
+
+const MAX_LIMIT = 10_000
+
+var operators = map[string]string{
+	"eq":  "=",
+	"neq": "<>",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+	"in":  "IN",
+}
+
+// Compiled is a parameterised statement, the merchant scope (when the target
+// needs one) always being the first argument.
+type Compiled struct {
+	SQL     string   `json:"sql"`
+	Args    []any    `json:"args"`
+	Columns []string `json:"columns"`
+}
+
+// Compile turns the query into SQL for the target. Only declared expressions
+// make it into the statement, caller values are always bound arguments.
+func (m *Model) Compile(q Query, target Target, merchant any) (Compiled, error) {
+	if len(q.Metrics) == 0 && len(q.Dimensions) == 0 {
+		return Compiled{}, fmt.Errorf("%w: at least one metric or dimension is required", ErrInvalidQuery)
+	}
+	if q.Limit < 0 || q.Limit > MAX_LIMIT {
+		return Compiled{}, fmt.Errorf("%w: limit must be between 0 and %d", ErrInvalidQuery, MAX_LIMIT)
+	}
+
+	required := make(map[string]bool)
+	selected := make(map[string]bool)
+	var selects, groups, columns []string
+
+	for _, name := range q.Dimensions {
+		dimension, ok := m.dimensions[name]
+		if !ok {
+			return Compiled{}, fmt.Errorf("%w: unknown dimension %q", ErrInvalidQuery, name)
+		}
+		if selected[name] {
+			return Compiled{}, fmt.Errorf("%w: %q selected twice", ErrInvalidQuery, name)
+		}
+		selected[name] = true
+		required[dimension.Entity] = true
+
+		selects = append(selects, fmt.Sprintf("%s AS %s", dimension.Expr, quote(name)))
+		groups = append(groups, dimension.Expr)
+		columns = append(columns, name)
+	}
+
+	for _, name := range q.Metrics {
+		metric, ok := m.metrics[name]
+		if !ok {
+			return Compiled{}, fmt.Errorf("%w: unknown metric %q", ErrInvalidQuery, name)
+		}
+		if selected[name] {
+			return Compiled{}, fmt.Errorf("%w: %q selected twice", ErrInvalidQuery, name)
+		}
+		selected[name] = true
+		for _, entity := range metric.Entities {
+			required[entity] = true
+		}
+
+		selects = append(selects, fmt.Sprintf("%s AS %s", metric.Expr, quote(name)))
+		columns = append(columns, name)
+	}
+
+	var where, having []string
+	var whereArgs, havingArgs []any
+	for _, filter := range q.Filters {
+		var expr string
+		var clause *[]string
+		var args *[]any
+		if dimension, ok := m.dimensions[filter.Field]; ok {
+			required[dimension.Entity] = true
+			expr, clause, args = dimension.Expr, &where, &whereArgs
+		} else if metric, ok := m.metrics[filter.Field]; ok {
+			for _, entity := range metric.Entities {
+				required[entity] = true
+			}
+			expr, clause, args = metric.Expr, &having, &havingArgs
+		} else {
+			return Compiled{}, fmt.Errorf("%w: unknown filter field %q", ErrInvalidQuery, filter.Field)
+		}
+
+		operator, ok := operators[filter.Operator]
+		if !ok {
+			return Compiled{}, fmt.Errorf("%w: unknown operator %q", ErrInvalidQuery, filter.Operator)
+		}
+		if filter.Operator == "in" {
+			if len(filter.Values) == 0 {
+				return Compiled{}, fmt.Errorf("%w: filter on %q needs values", ErrInvalidQuery, filter.Field)
+			}
+			placeholders := make([]string, len(filter.Values))
+			for i := range filter.Values {
+				placeholders[i] = "?"
+			}
+			*clause = append(*clause, fmt.Sprintf("%s IN (%s)", expr, strings.Join(placeholders, ", ")))
+			*args = append(*args, filter.Values...)
+		} else {
+			if filter.Value == nil {
+				return Compiled{}, fmt.Errorf("%w: filter on %q needs a value", ErrInvalidQuery, filter.Field)
+			}
+			*clause = append(*clause, fmt.Sprintf("%s %s ?", expr, operator))
+			*args = append(*args, filter.Value)
+		}
+	}
+
+	root, path, err := m.plan(required)
+	if err != nil {
+		return Compiled{}, err
+	}
+
+	for name := range required {
+		if m.entities[name].ServerOnly && !target.Scoped {
+			return Compiled{}, fmt.Errorf("%w: %q is not available to the %s", ErrInvalidQuery, name, target.Name)
+		}
+	}
+
+	from := []string{fmt.Sprintf("%s %s", target.Table(root.Table), root.Alias)}
+	for _, join := range path {
+		parent := m.entities[join.Parent]
+		from = append(from, fmt.Sprintf("JOIN %s %s ON %s", target.Table(parent.Table), parent.Alias, join.On))
+	}
+
+	if target.Scoped {
+		where = append([]string{fmt.Sprintf("%s.%s = ?", root.Alias, root.Scope)}, where...)
+		whereArgs = append([]any{merchant}, whereArgs...)
+	}
+
+	var order []string
+	for _, o := range q.Order {
+		if !selected[o.Field] {
+			return Compiled{}, fmt.Errorf("%w: can only order by selected fields, not %q", ErrInvalidQuery, o.Field)
+		}
+		switch strings.ToLower(o.Direction) {
+		case "", "asc":
+			order = append(order, quote(o.Field)+" ASC")
+		case "desc":
+			order = append(order, quote(o.Field)+" DESC")
+		default:
+			return Compiled{}, fmt.Errorf("%w: unknown order direction %q", ErrInvalidQuery, o.Direction)
+		}
+	}
+
+	distinct := ""
+	if len(q.Metrics) == 0 {
+		distinct = "DISTINCT "
+	}
+
+	var sql strings.Builder
+	fmt.Fprintf(&sql, "SELECT %s%s\nFROM %s", distinct, strings.Join(selects, ", "), strings.Join(from, "\n"))
+	if len(where) > 0 {
+		fmt.Fprintf(&sql, "\nWHERE %s", strings.Join(where, " AND "))
+	}
+	// filters on metrics aggregate per group even when no metric is selected
+	if len(groups) > 0 && (len(q.Metrics) > 0 || len(having) > 0) {
+		fmt.Fprintf(&sql, "\nGROUP BY %s", strings.Join(groups, ", "))
+	}
+	if len(having) > 0 {
+		fmt.Fprintf(&sql, "\nHAVING %s", strings.Join(having, " AND "))
+	}
+	if len(order) > 0 {
+		fmt.Fprintf(&sql, "\nORDER BY %s", strings.Join(order, ", "))
+	}
+	if q.Limit > 0 {
+		fmt.Fprintf(&sql, "\nLIMIT %d", q.Limit)
+	}
+
+	args := append(append([]any{}, whereArgs...), havingArgs...)
+	return Compiled{SQL: sql.String(), Args: args, Columns: columns}, nil
+}
+
+// plan picks the coarsest entity from which every required entity is reachable
+// through parent joins, so that rows are only fanned out when they have to be.
+func (m *Model) plan(required map[string]bool) (Entity, []Join, error) {
+	var names, wanted []string
+	for name := range m.entities {
+		names = append(names, name)
+	}
+	for name := range required {
+		wanted = append(wanted, name)
+	}
+	sort.Strings(names)
+	sort.Strings(wanted)
+
+	var best []Join
+	var root string
+	for _, candidate := range names {
+		reachable := m.ancestors(candidate)
+
+		var path []Join
+		seen := make(map[string]bool)
+		covered := true
+		for _, name := range wanted {
+			joins, ok := reachable[name]
+			if !ok {
+				covered = false
+				break
+			}
+			for _, join := range joins {
+				if !seen[join.Parent] {
+					seen[join.Parent] = true
+					path = append(path, join)
+				}
+			}
+		}
+		if !covered {
+			continue
+		}
+
+		if root == "" || len(reachable) < len(m.ancestors(root)) {
+			root, best = candidate, path
+		}
+	}
+
+	if root == "" {
+		return Entity{}, nil, fmt.Errorf("%w: no entity relates every requested field", ErrInvalidQuery)
+	}
+
+	// parents must be joined after their children, which sorting by path depth
+	// from the root guarantees.
+	reachable := m.ancestors(root)
+	sort.SliceStable(best, func(i, j int) bool {
+		return len(reachable[best[i].Parent]) < len(reachable[best[j].Parent])
+	})
+	return m.entities[root], best, nil
+}
+
+func quote(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
+
+func sortByName[T any](items []T, name func(T) string) {
+	sort.Slice(items, func(i, j int) bool { return name(items[i]) < name(items[j]) })
+}
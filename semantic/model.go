@@ -0,0 +1,144 @@
+package semantic
+
+import (
+	"fmt"
+)
+
+// Entity is a table of the merchant schema, queried under a fixed alias that
+// dimension and metric expressions refer to.
+type Entity struct {
+	Name  string
+	Table string
+	Alias string
+	// Scope is the column tying a row to its merchant.
+	Scope string
+	// ServerOnly entities are not part of merchant exports, so cannot be
+	// compiled for the browser.
+	ServerOnly bool
+}
+
+// Join is a many-to-one relation from a child entity to its parent.
+type Join struct {
+	Child  string
+	Parent string
+	On     string
+}
+
+type Dimension struct {
+	Name        string `json:"name"`
+	Entity      string `json:"entity"`
+	Expr        string `json:"-"`
+	Description string `json:"description"`
+}
+
+// Metric expressions are aggregates that must stay correct when rows of their
+// entity are fanned out by joins, summing at the finest grain or counting
+// distinct keys.
+type Metric struct {
+	Name        string   `json:"name"`
+	Entities    []string `json:"entities"`
+	Expr        string   `json:"-"`
+	Description string   `json:"description"`
+}
+
+type Model struct {
+	entities   map[string]Entity
+	joins      []Join
+	dimensions map[string]Dimension
+	metrics    map[string]Metric
+}
+
+func NewModel(entities []Entity, joins []Join, dimensions []Dimension, metrics []Metric) (*Model, error) {
+	m := &Model{
+		entities:   make(map[string]Entity),
+		dimensions: make(map[string]Dimension),
+		metrics:    make(map[string]Metric),
+	}
+
+	for _, entity := range entities {
+		m.entities[entity.Name] = entity
+	}
+	for _, join := range joins {
+		if _, ok := m.entities[join.Child]; !ok {
+			return nil, fmt.Errorf("join from unknown entity %q", join.Child)
+		}
+		if _, ok := m.entities[join.Parent]; !ok {
+			return nil, fmt.Errorf("join to unknown entity %q", join.Parent)
+		}
+		for _, existing := range m.joins {
+			if existing.Child == join.Child && existing.Parent == join.Parent {
+				return nil, fmt.Errorf("duplicate join from %q to %q", join.Child, join.Parent)
+			}
+		}
+		m.joins = append(m.joins, join)
+	}
+	for _, dimension := range dimensions {
+		if _, ok := m.entities[dimension.Entity]; !ok {
+			return nil, fmt.Errorf("dimension %q on unknown entity %q", dimension.Name, dimension.Entity)
+		}
+		m.dimensions[dimension.Name] = dimension
+	}
+	for _, metric := range metrics {
+		for _, entity := range metric.Entities {
+			if _, ok := m.entities[entity]; !ok {
+				return nil, fmt.Errorf("metric %q on unknown entity %q", metric.Name, entity)
+			}
+		}
+		if _, ok := m.dimensions[metric.Name]; ok {
+			return nil, fmt.Errorf("metric %q collides with a dimension", metric.Name)
+		}
+		m.metrics[metric.Name] = metric
+	}
+
+	return m, nil
+}
+
+func MustModel(entities []Entity, joins []Join, dimensions []Dimension, metrics []Metric) *Model {
+	m, err := NewModel(entities, joins, dimensions, metrics)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Catalogue lists what can be queried, for clients to discover.
+type Catalogue struct {
+	Dimensions []Dimension `json:"dimensions"`
+	Metrics    []Metric    `json:"metrics"`
+}
+
+func (m *Model) Catalogue() Catalogue {
+	var c Catalogue
+	for _, dimension := range m.dimensions {
+		c.Dimensions = append(c.Dimensions, dimension)
+	}
+	for _, metric := range m.metrics {
+		c.Metrics = append(c.Metrics, metric)
+	}
+	sortByName(c.Dimensions, func(d Dimension) string { return d.Name })
+	sortByName(c.Metrics, func(m Metric) string { return m.Name })
+	return c
+}
+
+// ancestors returns every entity reachable from the given one through parent
+// joins, paired with the join path used to get there. Joins are walked in their
+// declaration order so the chosen path, and the compiled SQL, is stable.
+func (m *Model) ancestors(entity string) map[string][]Join {
+	res := map[string][]Join{entity: nil}
+	queue := []string{entity}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, join := range m.joins {
+			if join.Child != current {
+				continue
+			}
+			if _, ok := res[join.Parent]; ok {
+				continue
+			}
+			res[join.Parent] = append(append([]Join{}, res[current]...), join)
+			queue = append(queue, join.Parent)
+		}
+	}
+	return res
+}
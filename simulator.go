@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	"github.com/suessflorian/client-side-analytics/telemetry"
+)
+
+const (
+	DIAGNOSTIC_SIMULATOR_RATE = "Simulator transactions/s"
+	DIAGNOSTIC_SIMULATOR_LAG  = "Simulator lag ms"
+)
+
+// SIMULATOR_BATCH is how often simulated traffic is written, simulated
+// transactions are at least this stale by the time they become visible.
+const SIMULATOR_BATCH = time.Second
+
+// SIMULATOR_PEAK_HOUR is the UTC hour traffic peaks at, troughing twelve hours
+// later.
+const SIMULATOR_PEAK_HOUR = 13
+
+const (
+	DEFAULT_DIURNAL = 0.8
+	MAX_TPS         = 10_000
+)
+
+var (
+	ErrInvalidSimulation = errors.New("invalid simulation")
+	ErrSimulatorRunning  = errors.New("simulator already running")
+	ErrSimulatorIdle     = errors.New("simulator never started")
+	ErrMerchantSimulated = errors.New("merchant is being simulated")
+)
+
+// simulator keeps appending point of sale traffic for a set of merchants until
+// stopped, one simulation running at a time.
+type simulator struct {
+	generator *generator
+
+	mu      sync.Mutex
+	current *simulation
+}
+
+func newSimulator(generator *generator) *simulator {
+	return &simulator{generator: generator}
+}
+
+// simulationParams describes the traffic, TPS being the average over a day
+// which the diurnal curve swings around by the Diurnal fraction.
+type simulationParams struct {
+	Merchants []uuid.UUID
+	TPS       float64
+	Diurnal   float64
+	Profile   profile
+}
+
+type simulation struct {
+	params    simulationParams
+	merchants []simulatedMerchant
+	rng       *rand.Rand
+	started   time.Time
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	mu           sync.Mutex
+	stopped      time.Time
+	transactions int
+	lines        int
+	rate         float64
+	lag          time.Duration
+	err          error
+}
+
+type simulatedMerchant struct {
+	id uuid.UUID
+	// products are ordered best selling first, so the popularity draw keeps
+	// the merchant's existing sales shape.
+	products   []product
+	popularity popularity
+	locations  locationWeights
+}
+
+type SimulatorStatus struct {
+	Running      bool        `json:"running"`
+	Merchants    []uuid.UUID `json:"merchants"`
+	TPS          float64     `json:"tps"`
+	Diurnal      float64     `json:"diurnal"`
+	StartedAt    time.Time   `json:"started_at"`
+	StoppedAt    *time.Time  `json:"stopped_at,omitempty"`
+	Transactions int         `json:"transactions"`
+	Lines        int         `json:"lines"`
+	// Rate is the transactions per second ingested by the latest batch.
+	Rate  float64 `json:"rate"`
+	LagMS int64   `json:"lag_ms"`
+	Error string  `json:"error,omitempty"`
+}
+
+func (p simulationParams) validate() error {
+	switch {
+	case len(p.Merchants) == 0:
+		return fmt.Errorf("%w: at least one merchant is required", ErrInvalidSimulation)
+	case p.TPS <= 0 || p.TPS > MAX_TPS:
+		return fmt.Errorf("%w: tps must lie within (0, %d]", ErrInvalidSimulation, MAX_TPS)
+	case p.Diurnal < 0 || p.Diurnal > 1:
+		return fmt.Errorf("%w: diurnal must lie within [0, 1]", ErrInvalidSimulation)
+	}
+	return nil
+}
+
+func (s *simulator) start(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, params simulationParams) (*simulation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && s.current.running() {
+		return nil, ErrSimulatorRunning
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	merchants, err := s.load(ctx, rng, params)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sim := &simulation{
+		params:    params,
+		merchants: merchants,
+		rng:       rng,
+		started:   time.Now(),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	s.current = sim
+
+	go sim.run(ctx, lg, reporter, s.generator)
+	return sim, nil
+}
+
+// load reads the products and locations of the simulated merchants, merchants
+// need products to sell to be simulated.
+func (s *simulator) load(ctx context.Context, rng *rand.Rand, params simulationParams) ([]simulatedMerchant, error) {
+	db := sql.OpenDB(s.generator.connector)
+
+	var res []simulatedMerchant
+	for _, id := range params.Merchants {
+		rows, err := db.QueryContext(ctx, `
+            SELECT p.id, p.price_cents
+            FROM main.products p
+            LEFT JOIN main.daily_product_rollups r ON r.product_id = p.id
+              WHERE p.merchant_id = ?
+            GROUP BY p.id, p.price_cents
+            ORDER BY COALESCE(SUM(r.units), 0) DESC, p.id;
+        `, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load products of merchant %s: %w", id, err)
+		}
+
+		merchant := simulatedMerchant{id: id}
+		for rows.Next() {
+			var product product
+			if err := rows.Scan(&product.id, &product.price); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan product of merchant %s: %w", id, err)
+			}
+			merchant.products = append(merchant.products, product)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to load products of merchant %s: %w", id, err)
+		}
+
+		if len(merchant.products) == 0 {
+			return nil, fmt.Errorf("%w: merchant %s has no products to sell", ErrInvalidSimulation, id)
+		}
+
+		// locations keep the share of traffic they have had so far, merchants
+		// without any selling nowhere in particular
+		rows, err = db.QueryContext(ctx, `
+            SELECT l.id, COUNT(t.id) + 1 AS weight
+            FROM main.locations l
+            LEFT JOIN main.transactions t ON t.location_id = l.id
+              WHERE l.merchant_id = ?
+            GROUP BY l.id
+            ORDER BY l.id;
+        `, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load locations of merchant %s: %w", id, err)
+		}
+		var total float64
+		for rows.Next() {
+			var location uuid.UUID
+			var weight float64
+			if err := rows.Scan(&location, &weight); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan location of merchant %s: %w", id, err)
+			}
+			total += weight
+			merchant.locations.ids = append(merchant.locations.ids, location)
+			merchant.locations.cumulative = append(merchant.locations.cumulative, total)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to load locations of merchant %s: %w", id, err)
+		}
+		merchant.popularity = newPopularity(rng, params.Profile, len(merchant.products))
+		res = append(res, merchant)
+	}
+	return res, nil
+}
+
+func (s *simulator) stop(ctx context.Context) (*simulation, error) {
+	s.mu.Lock()
+	sim := s.current
+	s.mu.Unlock()
+
+	if sim == nil {
+		return nil, ErrSimulatorIdle
+	}
+
+	sim.cancel()
+	select {
+	case <-sim.done:
+		return sim, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// exclusively runs fn without a simulation starting meanwhile, refusing while
+// the running one simulates the merchant.
+func (s *simulator) exclusively(merchantID uuid.UUID, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && s.current.running() && slices.Contains(s.current.params.Merchants, merchantID) {
+		return ErrMerchantSimulated
+	}
+	return fn()
+}
+
+func (s *simulator) get() (*simulation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		return nil, ErrSimulatorIdle
+	}
+	return s.current, nil
+}
+
+// diurnal scales the average rate along a daily cosine peaking at
+// SIMULATOR_PEAK_HOUR, which keeps the daily average at the configured TPS.
+func diurnal(at time.Time, amplitude float64) float64 {
+	at = at.UTC()
+	hours := float64(at.Hour()) + float64(at.Minute())/60 + float64(at.Second())/3600
+	return 1 + amplitude*math.Cos(2*math.Pi*(hours-SIMULATOR_PEAK_HOUR)/24)
+}
+
+func (sim *simulation) run(ctx context.Context, lg *logrus.Logger, reporter *telemetry.Reporter, g *generator) {
+	defer close(sim.done)
+	defer func() {
+		reporter.Set(DIAGNOSTIC_SIMULATOR_RATE, 0)
+
+		sim.mu.Lock()
+		defer sim.mu.Unlock()
+		sim.stopped = time.Now()
+	}()
+
+	lg.WithFields(logrus.Fields{"merchants": len(sim.merchants), "tps": sim.params.TPS}).Info("simulator started")
+	defer lg.Info("simulator stopped")
+
+	ticker := time.NewTicker(SIMULATOR_BATCH)
+	defer ticker.Stop()
+
+	// carry keeps fractions of transactions around, so low rates still produce
+	// traffic rather than being rounded away every batch
+	last, carry := sim.started, 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rate := sim.params.TPS * diurnal(now, sim.params.Diurnal)
+			expected := rate*now.Sub(last).Seconds() + carry
+			amount := int(expected)
+			carry = expected - float64(amount)
+
+			lines, err := sim.batch(ctx, g, last, now, amount)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					lg.WithError(err).Error("simulator failed to write traffic")
+					sim.mu.Lock()
+					sim.err = err
+					sim.mu.Unlock()
+				}
+				return
+			}
+
+			// the oldest simulated transaction of the batch is the stalest one
+			lag := time.Since(last)
+			ingested := float64(amount) / now.Sub(last).Seconds()
+			last = now
+
+			reporter.Set(DIAGNOSTIC_SIMULATOR_RATE, ingested)
+			reporter.Set(DIAGNOSTIC_SIMULATOR_LAG, lag.Milliseconds())
+			reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTIONS, g.overall.Transactions.Add(int64(amount)))
+			reporter.Set(DIAGNOSTIC_TOTAL_TRANSACTION_LINES, g.overall.Lines.Add(int64(lines)))
+
+			sim.mu.Lock()
+			sim.transactions += amount
+			sim.lines += lines
+			sim.rate, sim.lag = ingested, lag
+			sim.mu.Unlock()
+		}
+	}
+}
+
+// batch writes amount transactions spread over (from, to] in one transaction,
+// booking their sales against stock and refreshing the stock and rollups of
+// just the products sold, the latter only for the days touched. It reports
+// the lines written.
+func (sim *simulation) batch(ctx context.Context, g *generator, from, to time.Time, amount int) (int, error) {
+	if amount == 0 {
+		return 0, nil
+	}
+
+	conn, err := sql.OpenDB(g.connector).Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not connect: %w", err)
+	}
+	defer conn.Close()
+
+	var lines int
+	touched := make(map[uuid.UUID]map[uuid.UUID]bool)
+	err = atomically(ctx, conn, func() error {
+		if err := conn.Raw(func(driverConn any) (err error) {
+			lines, err = sim.append(driverConn.(driver.Conn), from, to, amount, touched)
+			return err
+		}); err != nil {
+			return err
+		}
+
+		for merchant, products := range touched {
+			if _, err := recordSales(ctx, conn, merchant, from.UTC()); err != nil {
+				return err
+			}
+			// none sold leaves nothing to refresh, rather than everything
+			if len(products) == 0 {
+				continue
+			}
+			sold := slices.Collect(maps.Keys(products))
+			if err := refreshStock(ctx, conn, merchant, sold); err != nil {
+				return err
+			}
+			if err := refreshRollups(ctx, conn, merchant, from.UTC(), sold); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return lines, err
+}
+
+func (sim *simulation) append(conn driver.Conn, from, to time.Time, amount int, touched map[uuid.UUID]map[uuid.UUID]bool) (int, error) {
+	transactions, err := duckdb.NewAppenderFromConn(conn, "", "transactions")
+	if err != nil {
+		return 0, fmt.Errorf("failed to establish appender for transactions: %w", err)
+	}
+	defer transactions.Close()
+
+	lines, err := duckdb.NewAppenderFromConn(conn, "", "transaction_lines")
+	if err != nil {
+		return 0, fmt.Errorf("failed to establish appender for transaction lines: %w", err)
+	}
+	defer lines.Close()
+
+	payments, err := duckdb.NewAppenderFromConn(conn, "", "payments")
+	if err != nil {
+		return 0, fmt.Errorf("failed to establish appender for payments: %w", err)
+	}
+	defer payments.Close()
+
+	profile, window := sim.params.Profile, to.Sub(from)
+	written := 0
+	for i := 0; i < amount; i++ {
+		merchant := sim.merchants[sim.rng.Intn(len(sim.merchants))]
+		if touched[merchant.id] == nil {
+			touched[merchant.id] = make(map[uuid.UUID]bool)
+		}
+
+		sale := transaction{id: uuid.New(), at: from.Add(time.Duration(sim.rng.Int63n(int64(window)))).UTC(), kind: TRANSACTION_SALE}
+		if len(merchant.locations.ids) > 0 {
+			location := merchant.locations.sample(sim.rng)
+			sale.location = &location
+		}
+		if err := appendTransaction(transactions, merchant.id, sale); err != nil {
+			return 0, err
+		}
+
+		basketLines := make([]line, profile.LinesPerTransaction.pick(sim.rng))
+		for j := range basketLines {
+			product := merchant.products[merchant.popularity.sample()]
+			basketLines[j] = line{id: uuid.New(), product: product.id, quantity: quantity(sim.rng, profile)}
+			touched[merchant.id][product.id] = true
+			basketLines[j].amount = int64(product.price) * int64(basketLines[j].quantity)
+		}
+		basket(sim.rng, profile, basketLines)
+
+		for _, l := range basketLines {
+			if err := appendLine(lines, sale.id, merchant.id, l); err != nil {
+				return 0, err
+			}
+			written++
+		}
+		for _, p := range tender(sim.rng, profile, total(basketLines)) {
+			if err := appendPayment(payments, uuid.New(), sale.id, merchant.id, p); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if err := transactions.Close(); err != nil {
+		return 0, fmt.Errorf("failed to flush transactions: %w", err)
+	}
+	if err := lines.Close(); err != nil {
+		return 0, fmt.Errorf("failed to flush transaction lines: %w", err)
+	}
+	if err := payments.Close(); err != nil {
+		return 0, fmt.Errorf("failed to flush payments: %w", err)
+	}
+	return written, nil
+}
+
+func (sim *simulation) running() bool {
+	select {
+	case <-sim.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (sim *simulation) status() SimulatorStatus {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	res := SimulatorStatus{
+		Running:      sim.running(),
+		Merchants:    sim.params.Merchants,
+		TPS:          sim.params.TPS,
+		Diurnal:      sim.params.Diurnal,
+		StartedAt:    sim.started,
+		Transactions: sim.transactions,
+		Lines:        sim.lines,
+		Rate:         sim.rate,
+		LagMS:        sim.lag.Milliseconds(),
+	}
+	if !res.Running {
+		res.StoppedAt = &sim.stopped
+	}
+	if sim.err != nil {
+		res.Error = sim.err.Error()
+	}
+	return res
+}
@@ -59,7 +59,12 @@ let currentDownloadMerchantID = null;
       try {
         const response = await fetch("/generate", { method: "POST" });
         if (response.ok) {
-          const data = await response.json();
+          const job = await waitForJob(await response.json());
+          if (job.status !== "completed") {
+            console.error(`generation job ${job.id} ${job.status}`, job.error ?? "");
+            return;
+          }
+          const data = job.result;
           console.log(`${data.Transactions.toLocaleString()} transactions, ${data.Lines.toLocaleString()} transaction lines - over ${data.Merchants.length.toLocaleString()} merchants`);
           data.Merchants.forEach((merchant) => {
             const p = document.createElement("p");
@@ -131,20 +136,47 @@ let currentDownloadMerchantID = null;
       }
     });
 
+    // waitForJob polls a generation job until it is no longer running.
+    const waitForJob = async (job) => {
+      while (job.status === "running") {
+        await new Promise((resolve) => setTimeout(resolve, 1000));
+        const response = await fetch(`/jobs/${job.id}`);
+        if (!response.ok) {
+          throw new Error(`failed to poll generation job ${job.id}`);
+        }
+        job = await response.json();
+      }
+      return job;
+    };
+
+    const topProducts = {
+      metrics: ["revenue"],
+      dimensions: ["product.id", "product.name"],
+      order: [
+        { field: "revenue", direction: "desc" },
+        { field: "product.name", direction: "asc" },
+      ],
+      limit: 5,
+    };
+
     const runAnalytics = async (merchantID) => {
       if (currentDownloadMerchantID === merchantID) {
         try {
-          const query = `SELECT
-          p.id AS product_id,
-          p.name AS product_name,
-          SUM(p.price_cents * tl.quantity) AS total_revenue
-        FROM main_products p
-        JOIN main_transaction_lines tl ON p.id = tl.product_id
-        GROUP BY p.id, p.name
-        ORDER BY total_revenue DESC, product_name ASC
-        LIMIT 5;`;
-
-          const result = await conn.query(query);
+          // the semantic layer compiles the same metric definitions the server
+          // uses against our local main_* tables.
+          const response = await fetch("/semantic/compile?target=browser", {
+            method: "POST",
+            body: JSON.stringify(topProducts),
+          });
+          if (!response.ok) {
+            console.error("Response not OK when compiling query");
+            return;
+          }
+          const compiled = await response.json();
+
+          const statement = await conn.prepare(compiled.sql);
+          const result = await statement.query(...compiled.args);
+          await statement.close();
           console.log(JSON.parse(JSON.stringify(result.toArray())));
 
         } catch (error) {
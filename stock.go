@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+)
+
+// Stock movements are signed like transaction lines: receipts bring stock in,
+// sales take it out, their voids and refunds putting it back, and adjustments
+// write off what went missing.
+const (
+	STOCK_RECEIPT    = "receipt"
+	STOCK_SALE       = "sale"
+	STOCK_ADJUSTMENT = "adjustment"
+)
+
+// Stock is reviewed every STOCK_REVIEW_DAYS, orders arriving STOCK_LEAD_DAYS
+// after being placed. Demand is forecast by exponential smoothing of the weekly
+// sales with a weight of STOCK_SMOOTHING on the latest week.
+const (
+	STOCK_REVIEW_DAYS = 7
+	STOCK_LEAD_DAYS   = 3
+	STOCK_SMOOTHING   = 0.3
+)
+
+// stock receives and writes off the merchant's stock around the sales already
+// written. Every product a location sells is opened with CoverDays of stock and
+// topped back up to that much of its forecast demand at each review, suppliers
+// only delivering part of an order now and then. Sales outrunning a delivery
+// are what leaves products out of stock.
+func (g *generator) stock(ctx context.Context, conn *sql.Conn, lg *logrus.Logger, w *worker, rng *rand.Rand, merchantID uuid.UUID, calendar *calendar, profile profile) error {
+	reviews := (profile.Days + STOCK_REVIEW_DAYS - 1) / STOCK_REVIEW_DAYS
+	rows, err := conn.QueryContext(ctx, `
+        SELECT
+          tl.product_id,
+          t.location_id,
+          least(greatest(date_diff('second', ?, t.created_at) // ?, 0), ?) AS review,
+          CAST(SUM(tl.quantity) AS BIGINT) AS units
+        FROM main.transaction_lines tl
+        JOIN main.transactions t ON t.id = tl.transaction_id
+          WHERE tl.merchant_id = ?
+        GROUP BY ALL
+        ORDER BY tl.product_id, t.location_id, review;
+    `, calendar.start, STOCK_REVIEW_DAYS*24*60*60, reviews-1, merchantID)
+	if err != nil {
+		return fmt.Errorf("failed to query weekly sales: %w", err)
+	}
+	defer rows.Close()
+
+	type shelf struct {
+		product  uuid.UUID
+		location uuid.NullUUID
+	}
+	var shelves []shelf
+	sold := make(map[shelf][]int64)
+	for rows.Next() {
+		var s shelf
+		var review int
+		var units int64
+		if err := rows.Scan(&s.product, &s.location, &review, &units); err != nil {
+			return fmt.Errorf("failed to scan weekly sales: %w", err)
+		}
+		if _, ok := sold[s]; !ok {
+			shelves = append(shelves, s)
+			sold[s] = make([]int64, reviews)
+		}
+		sold[s][review] = units
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("weekly sales iteration error: %w", err)
+	}
+
+	return conn.Raw(func(driverConn any) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "", "stock_movements")
+		if err != nil {
+			return fmt.Errorf("failed to establish appender for stock movements: %w", err)
+		}
+		defer appender.Close()
+
+		var written int
+		move := func(s shelf, kind string, quantity int64, at time.Time) error {
+			var location any
+			if s.location.Valid {
+				location = duckdb.UUID(s.location.UUID)
+			}
+			if err := appender.AppendRow(
+				duckdb.UUID(uuid.Must(uuid.NewRandomFromReader(rng))),
+				duckdb.UUID(s.product),
+				location,
+				kind,
+				int32(quantity),
+				nil,
+				at,
+				duckdb.UUID(merchantID),
+			); err != nil {
+				return fmt.Errorf("failed to append stock movement row: %w", err)
+			}
+			written++
+			w.wrote("stock_movements")
+			return nil
+		}
+
+		review := time.Duration(STOCK_REVIEW_DAYS) * 24 * time.Hour
+		for _, s := range shelves {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var total int64
+			for _, units := range sold[s] {
+				total += units
+			}
+			forecast := float64(total) / float64(reviews)
+
+			var onHand int64
+			for i, units := range sold[s] {
+				reviewed := calendar.start.Add(time.Duration(i)*review + time.Duration(profile.OpeningHour)*time.Hour)
+				target := int64(math.Ceil(forecast * profile.CoverDays / STOCK_REVIEW_DAYS))
+				switch {
+				case i == 0 && target > 0:
+					if err := move(s, STOCK_RECEIPT, target, reviewed); err != nil {
+						return err
+					}
+					onHand = target
+				case onHand < target:
+					delivered := target - onHand
+					if rng.Float64() >= profile.FillRate {
+						delivered = int64(float64(delivered) * rng.Float64())
+					}
+					arrival := reviewed.Add(STOCK_LEAD_DAYS * 24 * time.Hour)
+					if delivered > 0 && arrival.Before(calendar.until) {
+						if err := move(s, STOCK_RECEIPT, delivered, arrival); err != nil {
+							return err
+						}
+						onHand += delivered
+					}
+				}
+				onHand -= units
+
+				// shrinkage is counted at the end of the week it happened in
+				if onHand > 0 && profile.ShrinkRate > 0 {
+					counted := reviewed.Add(review - time.Hour)
+					lost := int64(math.Round(float64(onHand) * profile.ShrinkRate * 2 * rng.Float64()))
+					if lost > 0 && counted.Before(calendar.until) {
+						if err := move(s, STOCK_ADJUSTMENT, -lost, counted); err != nil {
+							return err
+						}
+						onHand -= lost
+					}
+				}
+				forecast += STOCK_SMOOTHING * (float64(units) - forecast)
+			}
+		}
+
+		// appended rows only reach the transaction once flushed
+		lg.WithField("quantity", written).Info("flushing stock movements to disk")
+		if err := appender.Close(); err != nil {
+			return fmt.Errorf("failed to flush stock movements: %w", err)
+		}
+		w.tracker.expect("stock_movements", written)
+		return nil
+	})
+}
+
+// recordSales books the merchant's transaction lines from the given time onwards
+// as sale movements, lines already booked being left alone so that it can be
+// run over whatever was just written. A movement's id is derived from its line
+// so generations stay reproducible.
+func recordSales(ctx context.Context, db execer, merchantID uuid.UUID, since time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+        INSERT INTO main.stock_movements
+          (id, product_id, location_id, kind, quantity, transaction_line_id, created_at, merchant_id)
+        SELECT
+          CAST(md5(CAST(tl.id AS VARCHAR)) AS UUID),
+          tl.product_id,
+          t.location_id,
+          ?,
+          -tl.quantity,
+          tl.id,
+          t.created_at,
+          tl.merchant_id
+        FROM main.transaction_lines tl
+        JOIN main.transactions t ON t.id = tl.transaction_id
+          WHERE tl.merchant_id = ? AND t.created_at >= ? AND tl.id NOT IN (
+            SELECT transaction_line_id
+            FROM main.stock_movements
+              WHERE merchant_id = ? AND kind = ? AND created_at >= ?
+          );
+    `, STOCK_SALE, merchantID, since, merchantID, STOCK_SALE, since)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record sales as stock movements: %w", err)
+	}
+	recorded, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count recorded sales: %w", err)
+	}
+	return recorded, nil
+}
+
+// refreshStock recomputes the merchant's stock levels, per product and location,
+// from all of its stock movements. Only the given products are recomputed, all
+// of them when there are none. Stock can be negative where more was sold than
+// was ever received.
+func refreshStock(ctx context.Context, db execer, merchantID uuid.UUID, products []uuid.UUID) error {
+	filter, args := inProducts("product_id", products)
+	args = append([]any{merchantID}, args...)
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`
+        DELETE FROM main.stock_levels WHERE merchant_id = ?%s;
+    `, and(filter)), args...); err != nil {
+		return fmt.Errorf("failed to clear stock levels: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`
+        INSERT INTO main.stock_levels (merchant_id, product_id, location_id, on_hand, updated_at)
+        SELECT merchant_id, product_id, location_id, SUM(quantity), MAX(created_at)
+        FROM main.stock_movements
+          WHERE merchant_id = ?%s
+        GROUP BY merchant_id, product_id, location_id;
+    `, and(filter)), args...); err != nil {
+		return fmt.Errorf("failed to rebuild stock levels: %w", err)
+	}
+	return nil
+}
@@ -2,10 +2,15 @@ package duckdb
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/fs"
 	"sort"
+	"strings"
+	"time"
 
 	"embed"
 
@@ -14,23 +19,95 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	where = "duck.db"
-)
-
 //go:embed migrations/*.sql
 var migrations embed.FS
 
 func Init(ctx context.Context, lg *logrus.Logger, path string) (*duckdb.Connector, error) {
-	connector, err := duckdb.NewConnector(where, nil)
+	connector, err := Open(ctx, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open duckdb connector: %v", err)
+		return nil, err
 	}
 
 	return migrate(ctx, lg, connector)
 }
 
-func migrate(ctx context.Context, lg *logrus.Logger, conn *duckdb.Connector) (*duckdb.Connector, error) {
+// Open connects to the database file at path without migrating it, for when
+// what the migrations would do is itself of interest.
+func Open(ctx context.Context, path string) (*duckdb.Connector, error) {
+	connector, err := duckdb.NewConnector(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open duckdb connector: %v", err)
+	}
+	return connector, nil
+}
+
+// Migrate applies the pending migrations to a database opened with Open.
+func Migrate(ctx context.Context, lg *logrus.Logger, conn *duckdb.Connector) error {
+	_, err := migrate(ctx, lg, conn)
+	return err
+}
+
+// ErrMigrationChanged refuses to run against a database whose applied
+// migrations no longer match the embedded ones.
+var ErrMigrationChanged = errors.New("applied migration changed")
+
+// Migration is one of the embedded migrations, Version being its file name
+// without the extension. AppliedAt is nil while pending, Changed tells that
+// the file no longer matches the checksum it was applied with.
+type Migration struct {
+	Version   string     `json:"version"`
+	Checksum  string     `json:"checksum"`
+	AppliedAt *time.Time `json:"applied_at"`
+	Changed   bool       `json:"changed,omitempty"`
+
+	content string
+}
+
+// Status lists the embedded migrations in the order they apply, as recorded
+// in the database's ledger.
+func Status(ctx context.Context, conn *duckdb.Connector) ([]Migration, error) {
+	res, err := embedded()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := ledger(ctx, sql.OpenDB(conn))
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		if entry, ok := applied[res[i].Version]; ok {
+			res[i].AppliedAt = entry.AppliedAt
+			res[i].Changed = entry.Checksum != res[i].Checksum
+		}
+	}
+	return res, nil
+}
+
+// ErrNotMigrated refuses to read a database whose schema is behind this
+// build, for commands that must not migrate it themselves.
+var ErrNotMigrated = errors.New("database not migrated")
+
+// Current checks that every embedded migration is applied as embedded.
+func Current(ctx context.Context, conn *duckdb.Connector) error {
+	migrations, err := Status(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if migration.AppliedAt == nil {
+			return fmt.Errorf("%w: %s is pending", ErrNotMigrated, migration.Version)
+		}
+		if migration.Changed {
+			return fmt.Errorf("%w: %s changed since it was applied", ErrNotMigrated, migration.Version)
+		}
+	}
+	return nil
+}
+
+// embedded reads the migration files in the order they apply, which is that of
+// their names.
+func embedded() ([]Migration, error) {
 	files, err := fs.Glob(migrations, "migrations/*.sql")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list migration files: %v", err)
@@ -38,19 +115,118 @@ func migrate(ctx context.Context, lg *logrus.Logger, conn *duckdb.Connector) (*d
 
 	sort.Strings(files)
 
-	quantity, last := 0, "none"
-	for _, file := range files {
+	res := make([]Migration, len(files))
+	for i, file := range files {
 		content, err := migrations.ReadFile(file)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read migration file %s: %v", file, err)
 		}
+		sum := sha256.Sum256(content)
+		res[i] = Migration{
+			Version:  strings.TrimSuffix(strings.TrimPrefix(file, "migrations/"), ".sql"),
+			Checksum: hex.EncodeToString(sum[:]),
+			content:  string(content),
+		}
+	}
+	return res, nil
+}
+
+// createLedger creates the ledger when the database predates it. Databases
+// migrated before the ledger existed have every migration applied anew once,
+// which the migrations of that time were written to allow.
+func createLedger(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS main.schema_migrations (
+          version VARCHAR PRIMARY KEY,
+          checksum VARCHAR,
+          applied_at TIMESTAMP,
+        );
+    `); err != nil {
+		return fmt.Errorf("failed to create migration ledger: %v", err)
+	}
+	return nil
+}
+
+// ledger reads the migrations applied so far by version, none without a
+// ledger, leaving the database untouched either way.
+func ledger(ctx context.Context, db *sql.DB) (map[string]Migration, error) {
+	res := make(map[string]Migration)
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `
+        SELECT EXISTS (
+          SELECT 1 FROM information_schema.tables
+            WHERE table_schema = 'main' AND table_name = 'schema_migrations'
+        );
+    `).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up migration ledger: %v", err)
+	}
+	if !exists {
+		return res, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+        SELECT version, checksum, applied_at FROM main.schema_migrations;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration ledger: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry Migration
+		if err := rows.Scan(&entry.Version, &entry.Checksum, &entry.AppliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan migration ledger: %v", err)
+		}
+		res[entry.Version] = entry
+	}
+	return res, rows.Err()
+}
+
+// migrate applies the migrations missing from the ledger in order, each in
+// its own transaction together with its ledger entry. It refuses to apply any
+// when an applied migration changed since, or is unknown to this build.
+func migrate(ctx context.Context, lg *logrus.Logger, conn *duckdb.Connector) (*duckdb.Connector, error) {
+	db := sql.OpenDB(conn)
+
+	files, err := embedded()
+	if err != nil {
+		return nil, err
+	}
+	if err := createLedger(ctx, db); err != nil {
+		return nil, err
+	}
+	applied, err := ledger(ctx, db)
+	if err != nil {
+		return nil, err
+	}
 
-		if _, err := sql.OpenDB(conn).ExecContext(ctx, string(content)); err != nil {
-			return nil, fmt.Errorf("failed to apply migration %s: %v", file, err)
+	known := make(map[string]bool, len(files))
+	for _, file := range files {
+		known[file.Version] = true
+		if entry, ok := applied[file.Version]; ok && entry.Checksum != file.Checksum {
+			return nil, fmt.Errorf("%w: %s was applied with checksum %s but is now %s", ErrMigrationChanged, file.Version, entry.Checksum, file.Checksum)
+		}
+	}
+	for version := range applied {
+		if !known[version] {
+			return nil, fmt.Errorf("%w: %s was applied but is not embedded in this build", ErrMigrationChanged, version)
+		}
+	}
+
+	quantity, last := 0, "none"
+	for _, file := range files {
+		if _, ok := applied[file.Version]; ok {
+			last = file.Version
+			continue
+		}
+
+		if err := apply(ctx, db, file); err != nil {
+			return nil, err
 		}
 
 		quantity++
-		last = file
+		last = file.Version
 	}
 
 	lg.WithFields(logrus.Fields{
@@ -62,3 +238,25 @@ func migrate(ctx context.Context, lg *logrus.Logger, conn *duckdb.Connector) (*d
 
 	return conn, nil
 }
+
+func apply(ctx context.Context, db *sql.DB, file Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %s: %v", file.Version, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, file.content); err != nil {
+		return fmt.Errorf("failed to apply migration %s: %v", file.Version, err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO main.schema_migrations (version, checksum, applied_at) VALUES (?, ?, ?);
+    `, file.Version, file.Checksum, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to record migration %s: %v", file.Version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %s: %v", file.Version, err)
+	}
+	return nil
+}
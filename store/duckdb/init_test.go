@@ -0,0 +1,110 @@
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+)
+
+func quiet() *logrus.Logger {
+	lg := logrus.New()
+	lg.SetOutput(io.Discard)
+	return lg
+}
+
+func open(t *testing.T) *duckdb.Connector {
+	t.Helper()
+
+	connector, err := Open(context.Background(), filepath.Join(t.TempDir(), "duck.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connector.Close() })
+	return connector
+}
+
+func TestStatusLeavesDatabaseUntouched(t *testing.T) {
+	ctx := context.Background()
+	connector := open(t)
+
+	migrations, err := Status(ctx, connector)
+	if err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for _, migration := range migrations {
+		if migration.AppliedAt != nil || migration.Changed {
+			t.Errorf("%s is reported applied on a fresh database", migration.Version)
+		}
+	}
+
+	var tables int
+	if err := sql.OpenDB(connector).QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'main';
+    `).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("status created %d tables, want none", tables)
+	}
+
+	if err := Current(ctx, connector); !errors.Is(err, ErrNotMigrated) {
+		t.Errorf("current = %v, want %v", err, ErrNotMigrated)
+	}
+}
+
+func TestMigrateRefusesChangedMigration(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tamper := range []string{
+		"UPDATE main.schema_migrations SET checksum = 'changed' WHERE version = '01_init';",
+		"INSERT INTO main.schema_migrations VALUES ('99_future', 'unknown', now());",
+	} {
+		connector := open(t)
+		if err := Migrate(ctx, quiet(), connector); err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+		if err := Current(ctx, connector); err != nil {
+			t.Fatalf("current after migrating = %v, want none", err)
+		}
+		// migrating again finds nothing pending
+		if err := Migrate(ctx, quiet(), connector); err != nil {
+			t.Fatalf("failed to migrate again: %v", err)
+		}
+
+		if _, err := sql.OpenDB(connector).ExecContext(ctx, tamper); err != nil {
+			t.Fatal(err)
+		}
+		if err := Migrate(ctx, quiet(), connector); !errors.Is(err, ErrMigrationChanged) {
+			t.Errorf("%s: migrate = %v, want %v", tamper, err, ErrMigrationChanged)
+		}
+	}
+
+	connector := open(t)
+	if err := Migrate(ctx, quiet(), connector); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if _, err := sql.OpenDB(connector).ExecContext(ctx, `
+        UPDATE main.schema_migrations SET checksum = 'changed' WHERE version = '01_init';
+    `); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := Status(ctx, connector)
+	if err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	if !migrations[0].Changed || migrations[0].Version != "01_init" {
+		t.Errorf("status reports %+v first, want 01_init changed", migrations[0])
+	}
+	if err := Current(ctx, connector); !errors.Is(err, ErrNotMigrated) {
+		t.Errorf("current = %v, want %v", err, ErrNotMigrated)
+	}
+}
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS main.daily_product_rollups (
+  merchant_id UUID, -- REFERENCES main.merchants(id)
+  product_id UUID, -- REFERENCES main.products(id)
+  day DATE,
+  revenue BIGINT,
+  units BIGINT,
+  transactions BIGINT,
+);
+
+-- backfill merchants that were generated before rollups were maintained
+INSERT INTO main.daily_product_rollups (merchant_id, product_id, day, revenue, units, transactions)
+SELECT
+  tl.merchant_id,
+  tl.product_id,
+  CAST(t.created_at AS DATE) AS day,
+  SUM(CAST(p.price_cents AS BIGINT) * tl.quantity) AS revenue,
+  SUM(tl.quantity) AS units,
+  COUNT(DISTINCT t.id) AS transactions
+FROM main.transaction_lines tl
+JOIN main.transactions t ON t.id = tl.transaction_id
+JOIN main.products p ON p.id = tl.product_id
+  WHERE tl.merchant_id NOT IN (SELECT DISTINCT merchant_id FROM main.daily_product_rollups)
+GROUP BY tl.merchant_id, tl.product_id, day;
@@ -0,0 +1,3 @@
+-- merchants record what they were generated from, so they can be reproduced
+ALTER TABLE main.merchants ADD COLUMN IF NOT EXISTS seed BIGINT;
+ALTER TABLE main.merchants ADD COLUMN IF NOT EXISTS generated_until TIMESTAMP;
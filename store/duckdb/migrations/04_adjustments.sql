@@ -0,0 +1,19 @@
+-- sales can be voided or refunded later on, the reversing transaction linking
+-- back to the sale
+ALTER TABLE main.transactions ADD COLUMN IF NOT EXISTS kind VARCHAR DEFAULT 'sale';
+ALTER TABLE main.transactions ADD COLUMN IF NOT EXISTS original_transaction_id UUID DEFAULT NULL; -- REFERENCES main.transactions(id)
+
+-- amounts are signed like the quantity, reversals carrying negative ones. Order
+-- level discounts are allocated over the lines of the order pro rata.
+ALTER TABLE main.transaction_lines ADD COLUMN IF NOT EXISTS discount_cents BIGINT DEFAULT 0;
+ALTER TABLE main.transaction_lines ADD COLUMN IF NOT EXISTS order_discount_cents BIGINT DEFAULT 0;
+ALTER TABLE main.transaction_lines ADD COLUMN IF NOT EXISTS tax_cents BIGINT DEFAULT 0;
+
+-- revenue is net of discounts and reversals, gross revenue being sales alone
+ALTER TABLE main.daily_product_rollups ADD COLUMN IF NOT EXISTS gross_revenue BIGINT;
+ALTER TABLE main.daily_product_rollups ADD COLUMN IF NOT EXISTS discounts BIGINT DEFAULT 0;
+ALTER TABLE main.daily_product_rollups ADD COLUMN IF NOT EXISTS returns BIGINT DEFAULT 0;
+ALTER TABLE main.daily_product_rollups ADD COLUMN IF NOT EXISTS tax BIGINT DEFAULT 0;
+
+-- rollups predating adjustments only ever covered undiscounted sales
+UPDATE main.daily_product_rollups SET gross_revenue = revenue WHERE gross_revenue IS NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS main.customers (
+  id UUID, -- PRIMARY KEY
+  created_at TIMESTAMP,
+  merchant_id UUID, -- REFERENCES main.merchants(id)
+);
+
+-- transactions stay anonymous unless the customer made themselves known, voids
+-- and refunds belonging to whoever made the sale
+ALTER TABLE main.transactions ADD COLUMN IF NOT EXISTS customer_id UUID DEFAULT NULL; -- REFERENCES main.customers(id)
@@ -0,0 +1,9 @@
+-- categories nest one level deep, subcategories naming their parent category
+CREATE TABLE IF NOT EXISTS main.categories (
+  id UUID, -- PRIMARY KEY
+  name VARCHAR,
+  parent_id UUID, -- REFERENCES main.categories(id)
+  merchant_id UUID, -- REFERENCES main.merchants(id)
+);
+
+ALTER TABLE main.products ADD COLUMN IF NOT EXISTS category_id UUID DEFAULT NULL; -- REFERENCES main.categories(id)
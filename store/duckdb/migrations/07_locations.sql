@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS main.locations (
+  id UUID, -- PRIMARY KEY
+  name VARCHAR,
+  merchant_id UUID, -- REFERENCES main.merchants(id)
+);
+
+-- transactions predating locations belong to no location in particular, voids
+-- and refunds are made wherever the sale was
+ALTER TABLE main.transactions ADD COLUMN IF NOT EXISTS location_id UUID DEFAULT NULL; -- REFERENCES main.locations(id)
+
+ALTER TABLE main.daily_product_rollups ADD COLUMN IF NOT EXISTS location_id UUID DEFAULT NULL; -- REFERENCES main.locations(id)
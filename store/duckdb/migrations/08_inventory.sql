@@ -0,0 +1,44 @@
+-- stock moves in signed quantities per product and location: receipts bring it
+-- in, sales take it out and adjustments write it off. Sale movements name the
+-- transaction line they book.
+CREATE TABLE IF NOT EXISTS main.stock_movements (
+  id UUID, -- PRIMARY KEY
+  product_id UUID, -- REFERENCES main.products(id)
+  location_id UUID, -- REFERENCES main.locations(id)
+  kind VARCHAR,
+  quantity INTEGER,
+  transaction_line_id UUID, -- REFERENCES main.transaction_lines(id)
+  created_at TIMESTAMP,
+  merchant_id UUID, -- REFERENCES main.merchants(id)
+);
+
+-- stock levels are derived from the movements
+CREATE TABLE IF NOT EXISTS main.stock_levels (
+  merchant_id UUID, -- REFERENCES main.merchants(id)
+  product_id UUID, -- REFERENCES main.products(id)
+  location_id UUID, -- REFERENCES main.locations(id)
+  on_hand BIGINT,
+  updated_at TIMESTAMP,
+);
+
+-- backfill the sales of merchants that predate stock tracking, nothing having
+-- ever been received for them
+INSERT INTO main.stock_movements (id, product_id, location_id, kind, quantity, transaction_line_id, created_at, merchant_id)
+SELECT
+  CAST(md5(CAST(tl.id AS VARCHAR)) AS UUID),
+  tl.product_id,
+  t.location_id,
+  'sale',
+  -tl.quantity,
+  tl.id,
+  t.created_at,
+  tl.merchant_id
+FROM main.transaction_lines tl
+JOIN main.transactions t ON t.id = tl.transaction_id
+  WHERE tl.merchant_id NOT IN (SELECT DISTINCT merchant_id FROM main.stock_movements);
+
+INSERT INTO main.stock_levels (merchant_id, product_id, location_id, on_hand, updated_at)
+SELECT merchant_id, product_id, location_id, SUM(quantity), MAX(created_at)
+FROM main.stock_movements
+  WHERE merchant_id NOT IN (SELECT DISTINCT merchant_id FROM main.stock_levels)
+GROUP BY merchant_id, product_id, location_id;
@@ -0,0 +1,10 @@
+-- payments settle a transaction's lines, tax included, in one or more tenders.
+-- Voids and refunds pay back with negative amounts, transactions predating
+-- payments have none.
+CREATE TABLE IF NOT EXISTS main.payments (
+  id UUID, -- PRIMARY KEY
+  transaction_id UUID, -- REFERENCES main.transactions(id)
+  tender VARCHAR,
+  amount_cents BIGINT,
+  merchant_id UUID, -- REFERENCES main.merchants(id)
+);
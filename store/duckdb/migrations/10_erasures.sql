@@ -0,0 +1,10 @@
+-- erasures are the receipts of merchants erased on request, erased holding the
+-- rows purged per table as JSON. Deliberately without a merchant_id column so
+-- the receipts outlive the merchant and are never exported along with them.
+CREATE TABLE IF NOT EXISTS main.erasures (
+  id UUID, -- PRIMARY KEY
+  merchant UUID,
+  name VARCHAR,
+  erased VARCHAR,
+  erased_at TIMESTAMP,
+);
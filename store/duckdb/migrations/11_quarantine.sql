@@ -0,0 +1,10 @@
+-- quarantine holds rows the integrity validator took out of the merchant
+-- tables, row being the row as DuckDB renders it as text. Like erasures it
+-- names its merchant column so that merchant table discovery passes it by.
+CREATE TABLE IF NOT EXISTS main.quarantine (
+  source VARCHAR,
+  reason VARCHAR,
+  merchant UUID,
+  row VARCHAR,
+  quarantined_at TIMESTAMP,
+);
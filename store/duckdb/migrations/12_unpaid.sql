@@ -0,0 +1,14 @@
+-- transactions predating payments are settled in full in an unknown tender, so
+-- that tender mix accounts for every transaction
+INSERT INTO main.payments (id, transaction_id, tender, amount_cents, merchant_id)
+SELECT
+  CAST(md5(CAST(t.id AS VARCHAR)) AS UUID),
+  t.id,
+  'unknown',
+  COALESCE(SUM(CAST(p.price_cents AS BIGINT) * tl.quantity - tl.discount_cents - tl.order_discount_cents + tl.tax_cents), 0),
+  t.merchant_id
+FROM main.transactions t
+LEFT JOIN main.transaction_lines tl ON tl.transaction_id = t.id
+LEFT JOIN main.products p ON p.id = tl.product_id
+  WHERE t.id NOT IN (SELECT transaction_id FROM main.payments)
+GROUP BY t.id, t.merchant_id;
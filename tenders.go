@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// tenderIntervals are the periods tender mix can be reported over.
+var tenderIntervals = map[string]bool{"day": true, "week": true, "month": true}
+
+// TenderMix breaks a period's payments down by tender. Amounts are net of what
+// voids and refunds paid back and include tax.
+type TenderMix struct {
+	Period  time.Time      `json:"period"`
+	Amount  int64          `json:"amount"`
+	Tenders []TenderAmount `json:"tenders"`
+	// SplitSales counts the sales paid with more than one tender.
+	SplitSales int64 `json:"split_sales"`
+}
+
+type TenderAmount struct {
+	Tender   string `json:"tender"`
+	Amount   int64  `json:"amount"`
+	Payments int64  `json:"payments"`
+	// Share is the tender's share of the period's amount.
+	Share float64 `json:"share"`
+}
+
+// GetTenderMix returns how the merchant got paid per day, week or month.
+func (a *analytics) GetTenderMix(ctx context.Context, merchantID uuid.UUID, locations []uuid.UUID, interval string) ([]TenderMix, error) {
+	if !tenderIntervals[interval] {
+		return nil, fmt.Errorf("unknown tender interval %q", interval)
+	}
+
+	filter, args := inLocations("t.location_id", locations)
+	query := fmt.Sprintf(`
+        WITH paid AS (
+          SELECT
+            CAST(date_trunc('%s', t.created_at) AS TIMESTAMP) AS period,
+            pay.transaction_id,
+            pay.tender,
+            pay.amount_cents,
+            t.kind = ? AS sale,
+            COUNT(*) OVER (PARTITION BY pay.transaction_id) > 1 AS split
+          FROM main.payments pay
+          JOIN main.transactions t ON t.id = pay.transaction_id
+            WHERE pay.merchant_id = ?%s
+        ), splits AS (
+          SELECT period, COUNT(DISTINCT transaction_id) FILTER (WHERE sale AND split) AS split_sales
+          FROM paid
+          GROUP BY period
+        )
+        SELECT
+          period,
+          paid.tender,
+          CAST(SUM(paid.amount_cents) AS BIGINT) AS amount,
+          COUNT(*) FILTER (WHERE paid.sale) AS payments,
+          any_value(splits.split_sales) AS split_sales
+        FROM paid
+        JOIN splits USING (period)
+        GROUP BY period, paid.tender
+        ORDER BY period ASC, paid.tender ASC;
+    `, interval, and(filter))
+	args = append([]any{TRANSACTION_SALE, merchantID}, args...)
+	rows, err := sql.OpenDB(a.connector).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	res := []TenderMix{}
+	for rows.Next() {
+		var period time.Time
+		var tender TenderAmount
+		var splits int64
+		if err := rows.Scan(&period, &tender.Tender, &tender.Amount, &tender.Payments, &splits); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if len(res) == 0 || !res[len(res)-1].Period.Equal(period) {
+			res = append(res, TenderMix{Period: period, SplitSales: splits})
+		}
+		mix := &res[len(res)-1]
+		mix.Amount += tender.Amount
+		mix.Tenders = append(mix.Tenders, tender)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	for i := range res {
+		mix := &res[i]
+		for j := range mix.Tenders {
+			if mix.Amount != 0 {
+				mix.Tenders[j].Share = float64(mix.Tenders[j].Amount) / float64(mix.Amount)
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	"github.com/suessflorian/client-side-analytics/semantic"
+	store "github.com/suessflorian/client-side-analytics/store/duckdb"
+)
+
+// MAX_REPORTED_DIFFERENCES caps how many differing values are listed per query.
+const MAX_REPORTED_DIFFERENCES = 20
+
+type fidelityReport struct {
+	Merchant uuid.UUID       `json:"merchant"`
+	Queries  []queryFidelity `json:"queries"`
+}
+
+type queryFidelity struct {
+	Name        string   `json:"name"`
+	ServerRows  int      `json:"server_rows"`
+	BrowserRows int      `json:"browser_rows"`
+	Differences []string `json:"differences"`
+}
+
+func (r fidelityReport) Faithful() bool {
+	for _, query := range r.Queries {
+		if len(query.Differences) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// endpoints are the analytics served outside of the semantic model, each of
+// which must also be reproducible from a merchant export.
+var endpoints = []struct {
+	Name string
+	Run  func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error)
+}{
+	{"analytics.top_products", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetTopProducts(ctx, merchantID, nil)
+	}},
+	{"analytics.daily_revenue", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetDailyRevenue(ctx, merchantID, nil)
+	}},
+	{"pivot", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.Pivot(ctx, merchantID, pivotRequest{
+			Dimensions: []string{"category", "month"},
+			Measures:   []string{"revenue", "gross_revenue", "discounts", "returns", "tax", "units"},
+			Subtotals:  SUBTOTALS_ROLLUP,
+		})
+	}},
+	{"pivot.hourly", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.Pivot(ctx, merchantID, pivotRequest{
+			Dimensions: []string{"location", "weekday", "hour"},
+			Measures:   []string{"revenue", "transactions"},
+		})
+	}},
+	{"categories", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetCategoryRevenue(ctx, merchantID, nil)
+	}},
+	{"locations", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetLocationRevenue(ctx, merchantID, nil)
+	}},
+	{"tenders", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetTenderMix(ctx, merchantID, nil, "month")
+	}},
+	{"inventory", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetInventory(ctx, merchantID, nil, INVENTORY_DAYS)
+	}},
+	{"stockouts", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetStockouts(ctx, merchantID, nil, INVENTORY_DAYS, STOCKOUT_DAYS)
+	}},
+	{"retention", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetRetentionCohorts(ctx, merchantID, nil)
+	}},
+	{"lifetime_value", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetLifetimeValue(ctx, merchantID, nil)
+	}},
+	{"new_vs_returning", func(a *analytics, ctx context.Context, merchantID uuid.UUID) (any, error) {
+		return a.GetCustomerSplit(ctx, merchantID, nil)
+	}},
+}
+
+// verifyRoundTrip exports the merchant like the loader does, loads the export into
+// a scratch in-memory database the way the browser does and compares every
+// registered query across the two. The endpoints are then compared against the
+// export rebuilt into the merchant schema, their derived tables included.
+func (a *analytics) verifyRoundTrip(ctx context.Context, merchantID uuid.UUID) (fidelityReport, error) {
+	var export bytes.Buffer
+	if err := a.csvDump(ctx, &export, merchantID, nil); err != nil {
+		return fidelityReport{}, fmt.Errorf("failed to export merchant: %w", err)
+	}
+
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		return fidelityReport{}, fmt.Errorf("failed to open in-memory duckdb: %w", err)
+	}
+	defer connector.Close()
+	browser := sql.OpenDB(connector)
+	defer browser.Close()
+
+	if err := loadExport(ctx, browser, export.Bytes()); err != nil {
+		return fidelityReport{}, err
+	}
+
+	report := fidelityReport{Merchant: merchantID}
+	for _, query := range registered {
+		server, err := metrics.Compile(query.Query, semantic.Server, merchantID)
+		if err != nil {
+			return fidelityReport{}, fmt.Errorf("failed to compile %s for the server: %w", query.Name, err)
+		}
+		local, err := metrics.Compile(query.Query, semantic.Browser, nil)
+		if err != nil {
+			return fidelityReport{}, fmt.Errorf("failed to compile %s for the browser: %w", query.Name, err)
+		}
+
+		expected, err := collect(ctx, sql.OpenDB(a.connector), server)
+		if err != nil {
+			return fidelityReport{}, fmt.Errorf("failed to run %s on the server: %w", query.Name, err)
+		}
+		actual, err := collect(ctx, browser, local)
+		if err != nil {
+			return fidelityReport{}, fmt.Errorf("failed to run %s on the export: %w", query.Name, err)
+		}
+
+		report.Queries = append(report.Queries, compare(query.Name, expected, actual))
+	}
+
+	if err := rebuild(ctx, connector, merchantID); err != nil {
+		return fidelityReport{}, err
+	}
+	for _, endpoint := range endpoints {
+		expected, err := endpoint.Run(a, ctx, merchantID)
+		if err != nil {
+			return fidelityReport{}, fmt.Errorf("failed to run %s on the server: %w", endpoint.Name, err)
+		}
+		actual, err := endpoint.Run(&analytics{connector}, ctx, merchantID)
+		if err != nil {
+			return fidelityReport{}, fmt.Errorf("failed to run %s on the export: %w", endpoint.Name, err)
+		}
+
+		fidelity, err := compareJSON(endpoint.Name, expected, actual)
+		if err != nil {
+			return fidelityReport{}, err
+		}
+		report.Queries = append(report.Queries, fidelity)
+	}
+
+	return report, nil
+}
+
+// rebuild migrates the scratch database and copies the export loaded into it
+// over to the merchant tables under the merchant's own ids, then rebuilds the
+// derived tables the export leaves out.
+func rebuild(ctx context.Context, connector *duckdb.Connector, merchantID uuid.UUID) error {
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	if err := store.Migrate(ctx, quiet, connector); err != nil {
+		return fmt.Errorf("failed to migrate scratch database: %w", err)
+	}
+
+	db := sql.OpenDB(connector)
+	tables, err := merchantTables(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if derived[table.Name] {
+			continue
+		}
+
+		columns, err := tableColumns(ctx, db, table)
+		if err != nil {
+			return err
+		}
+		var names, values []string
+		for _, col := range columns {
+			names = append(names, ident(col.name))
+			values = append(values, fmt.Sprintf("CAST(%s AS %s)", ident(col.name), col.dataType))
+		}
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			"INSERT INTO %s.%s (%s, merchant_id) SELECT %s, ? FROM %s;",
+			ident(table.Schema), ident(table.Name), strings.Join(names, ", "),
+			strings.Join(values, ", "), ident(table.Schema+"_"+table.Name),
+		), merchantID); err != nil {
+			return fmt.Errorf("failed to rebuild %s from the export: %w", table.Name, err)
+		}
+	}
+
+	if err := refreshStock(ctx, db, merchantID, nil); err != nil {
+		return err
+	}
+	return refreshRollups(ctx, db, merchantID, time.Time{}, nil)
+}
+
+// loadExport mirrors static/script.js, every CSV of the zip becomes a table named
+// after the file through read_csv_auto.
+func loadExport(ctx context.Context, db *sql.DB, export []byte) error {
+	archive, err := zip.NewReader(bytes.NewReader(export), int64(len(export)))
+	if err != nil {
+		return fmt.Errorf("failed to read export archive: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "verify-*")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range archive.File {
+		if !strings.HasSuffix(file.Name, ".csv") {
+			continue
+		}
+
+		path := filepath.Join(dir, filepath.Base(file.Name))
+		if err := extract(file, path); err != nil {
+			return err
+		}
+
+		table := strings.TrimSuffix(filepath.Base(file.Name), ".csv")
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			"CREATE TABLE %s AS SELECT * FROM read_csv_auto('%s', HEADER=TRUE, SAMPLE_SIZE=-1);",
+			table, path,
+		)); err != nil {
+			return fmt.Errorf("failed to load %s: %w", file.Name, err)
+		}
+	}
+	return nil
+}
+
+func extract(file *zip.File, path string) error {
+	src, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open %s in export: %w", file.Name, err)
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", file.Name, err)
+	}
+	return nil
+}
+
+type resultSet struct {
+	columns []string
+	types   []string
+	rows    [][]any
+}
+
+func collect(ctx context.Context, db *sql.DB, compiled semantic.Compiled) (resultSet, error) {
+	rows, err := db.QueryContext(ctx, compiled.SQL, compiled.Args...)
+	if err != nil {
+		return resultSet{}, err
+	}
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return resultSet{}, err
+	}
+
+	res := resultSet{columns: compiled.Columns}
+	for _, colType := range colTypes {
+		res.types = append(res.types, colType.DatabaseTypeName())
+	}
+
+	for rows.Next() {
+		values := make([]any, len(colTypes))
+		pointers := make([]any, len(colTypes))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return resultSet{}, err
+		}
+		res.rows = append(res.rows, values)
+	}
+	return res, rows.Err()
+}
+
+// compareJSON compares endpoint results value by value as they are served,
+// rows being the elements of a list result or of the longest list it holds.
+func compareJSON(name string, expected, actual any) (queryFidelity, error) {
+	var values [2]any
+	for i, result := range []any{expected, actual} {
+		raw, err := json.Marshal(result)
+		if err != nil {
+			return queryFidelity{}, fmt.Errorf("failed to marshal %s: %w", name, err)
+		}
+		if err := json.Unmarshal(raw, &values[i]); err != nil {
+			return queryFidelity{}, fmt.Errorf("failed to unmarshal %s: %w", name, err)
+		}
+	}
+
+	res := queryFidelity{
+		Name:        name,
+		ServerRows:  rowCount(values[0]),
+		BrowserRows: rowCount(values[1]),
+		Differences: []string{},
+	}
+
+	server, browser := leaves("", values[0], map[string]any{}), leaves("", values[1], map[string]any{})
+	paths := make([]string, 0, len(server))
+	for path := range server {
+		paths = append(paths, path)
+	}
+	for path := range browser {
+		if _, ok := server[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+
+	differing := 0
+	for _, path := range paths {
+		x, onServer := server[path]
+		y, inExport := browser[path]
+		if onServer && inExport && equivalent(x, y) {
+			continue
+		}
+		if differing++; differing > MAX_REPORTED_DIFFERENCES {
+			continue
+		}
+		switch {
+		case !inExport:
+			res.Differences = append(res.Differences, fmt.Sprintf("%s is %v on the server but missing in the export", path, x))
+		case !onServer:
+			res.Differences = append(res.Differences, fmt.Sprintf("%s is missing on the server but %v in the export", path, y))
+		default:
+			res.Differences = append(res.Differences, fmt.Sprintf("%s is %v on the server but %v in the export", path, x, y))
+		}
+	}
+	if differing > MAX_REPORTED_DIFFERENCES {
+		res.Differences = append(res.Differences, fmt.Sprintf(
+			"%d further differing values", differing-MAX_REPORTED_DIFFERENCES,
+		))
+	}
+
+	return res, nil
+}
+
+func rowCount(val any) int {
+	switch v := val.(type) {
+	case []any:
+		return len(v)
+	case map[string]any:
+		rows := 1
+		for _, field := range v {
+			if list, ok := field.([]any); ok {
+				rows = max(rows, len(list))
+			}
+		}
+		return rows
+	}
+	return 1
+}
+
+// leaves flattens a decoded JSON value into its scalars keyed by their path.
+func leaves(path string, val any, res map[string]any) map[string]any {
+	switch v := val.(type) {
+	case []any:
+		for i, item := range v {
+			leaves(fmt.Sprintf("%s[%d]", path, i), item, res)
+		}
+	case map[string]any:
+		for key, item := range v {
+			leaves(strings.TrimPrefix(path+"."+key, "."), item, res)
+		}
+	default:
+		res[path] = v
+	}
+	return res
+}
+
+func compare(name string, expected, actual resultSet) queryFidelity {
+	res := queryFidelity{
+		Name:        name,
+		ServerRows:  len(expected.rows),
+		BrowserRows: len(actual.rows),
+		Differences: []string{},
+	}
+
+	for i, column := range expected.columns {
+		if expected.types[i] != actual.types[i] {
+			res.Differences = append(res.Differences, fmt.Sprintf(
+				"column %q is %s on the server but %s in the export", column, expected.types[i], actual.types[i],
+			))
+		}
+	}
+
+	if len(expected.rows) != len(actual.rows) {
+		res.Differences = append(res.Differences, fmt.Sprintf(
+			"%d rows on the server but %d in the export", len(expected.rows), len(actual.rows),
+		))
+	}
+
+	values := 0
+	for r := 0; r < min(len(expected.rows), len(actual.rows)); r++ {
+		for c, column := range expected.columns {
+			if equivalent(expected.rows[r][c], actual.rows[r][c]) {
+				continue
+			}
+			if values++; values > MAX_REPORTED_DIFFERENCES {
+				continue
+			}
+			res.Differences = append(res.Differences, fmt.Sprintf(
+				"row %d column %q is %v on the server but %v in the export",
+				r, column, scalar(expected.rows[r][c]), scalar(actual.rows[r][c]),
+			))
+		}
+	}
+	if values > MAX_REPORTED_DIFFERENCES {
+		res.Differences = append(res.Differences, fmt.Sprintf(
+			"%d further differing values", values-MAX_REPORTED_DIFFERENCES,
+		))
+	}
+
+	return res
+}
+
+// equivalent compares values independently of the driver type they came back as,
+// type mismatches being reported per column already.
+func equivalent(a, b any) bool {
+	a, b = scalar(a), scalar(b)
+
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return x == y || math.Abs(x-y) <= 1e-9*math.Max(math.Abs(x), math.Abs(y))
+		}
+	}
+	if x, ok := a.(time.Time); ok {
+		if y, ok := b.(time.Time); ok {
+			return x.Equal(y)
+		}
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func number(val any) (float64, bool) {
+	switch v := val.(type) {
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suessflorian/client-side-analytics/telemetry"
+)
+
+const DIAGNOSTIC_WORKER_THROUGHPUT = "Generator worker %d rows/s"
+
+// THROUGHPUT_SAMPLE is how many rows a worker writes between throughput reports.
+const THROUGHPUT_SAMPLE = 10_000
+
+// task asks a worker to generate one merchant, the outcome is sent to done.
+type task struct {
+	ctx      context.Context
+	lg       *logrus.Logger
+	reporter *telemetry.Reporter
+	tracker  *progress
+	merchant Merchant
+	params   generation
+	done     chan<- outcome
+}
+
+type outcome struct {
+	merchant     Merchant
+	products     int
+	transactions int
+	lines        int
+	customers    int
+	err          error
+}
+
+// worker writes one merchant at a time on its own connections, reporting its
+// throughput while it does.
+type worker struct {
+	id       int
+	tracker  *progress
+	reporter *telemetry.Reporter
+	started  time.Time
+	rows     int
+}
+
+func (g *generator) work(ctx context.Context, id int) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-g.tasks:
+			w := &worker{id: id, tracker: t.tracker, reporter: t.reporter, started: time.Now()}
+			o := g.generate(t, w)
+			w.idle()
+			t.done <- o
+		}
+	}
+}
+
+func (w *worker) wrote(table string) {
+	w.tracker.wrote(table, 1)
+	if w.rows++; w.rows%THROUGHPUT_SAMPLE == 0 {
+		w.report()
+	}
+}
+
+// wroteMany accounts for rows written in one statement by bulk generation.
+func (w *worker) wroteMany(table string, amount int) {
+	w.tracker.wrote(table, amount)
+	w.rows += amount
+	w.report()
+}
+
+func (w *worker) report() {
+	if elapsed := time.Since(w.started).Seconds(); elapsed > 0 {
+		w.reporter.Set(fmt.Sprintf(DIAGNOSTIC_WORKER_THROUGHPUT, w.id), int(float64(w.rows)/elapsed))
+	}
+}
+
+func (w *worker) idle() {
+	w.reporter.Set(fmt.Sprintf(DIAGNOSTIC_WORKER_THROUGHPUT, w.id), 0)
+}